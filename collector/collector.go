@@ -1,218 +1,1772 @@
+//go:build linux || (freebsd && amd64)
+// +build linux freebsd,amd64
+
 package collector
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
-	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/procfs"
+	"github.com/prometheus/common/log"
 )
 
-const userHZ = 100
+const (
+	userHZ = 100
+
+	// Transient failures to read /proc are retried up to retryCount times,
+	// doubling the delay each time, for at most 70ms in total.
+	retryCount   = 3
+	retryBackoff = 10 * time.Millisecond
+
+	// progressInterval is the number of processes between progress
+	// messages at debug level, to tell a long scrape from a hung one.
+	progressInterval = 500
+
+	// nativeBucketFactor is the growth factor of the buckets of native
+	// histograms, the one client_golang suggests.
+	nativeBucketFactor = 1.1
+)
 
 type (
+	// ProcSource lists the processes of the host and reads their stats. It
+	// is implemented with procfs on Linux and with the kern.proc sysctls
+	// on FreeBSD.
+	ProcSource interface {
+		// PIDs returns the IDs of all processes, not of their threads.
+		PIDs() ([]int, error)
+		// BootTime returns the boot time of the host in seconds since
+		// the epoch.
+		BootTime() (float64, error)
+		// Stat returns the stats of a process. It fails if the process
+		// exited.
+		Stat(pid int) (ProcStat, error)
+	}
+
+	// ProcStat holds the stats of a process a ProcSource provides on all
+	// platforms. Further metrics are read from procfs on Linux only.
+	ProcStat struct {
+		PID     int
+		PPID    int
+		PGID    int
+		SID     int
+		Comm    string
+		Cmdline []string
+		// UID is the owner of the process, -1 if unknown.
+		UID int
+		// TTY is the device number of the controlling terminal, 0 if
+		// none.
+		TTY int
+		// CPU times and the start time since boot are in seconds,
+		// memory in bytes.
+		CPUUser        float64
+		CPUSystem      float64
+		VirtualMemory  float64
+		ResidentMemory float64
+		NumThreads     uint64
+		MajorFaults    uint64
+		StartTime      float64
+		// BlkioDelay is the time spent waiting for block IO from delay
+		// accounting, 0 where unavailable.
+		BlkioDelay float64
+	}
+
 	groupKey struct {
 		account   string
 		groupname string
 	}
 
-	procGroup struct {
-		name            string
-		account         string
-		cpuSystem       float64
-		cpuUser         float64
-		memVirt         uint64
-		memRss          uint64
-		numProcs        uint64
-		numThreads      uint64
-		oldestStartTime float64
+	// stageDurations are the durations of the stages of readProcGroups:
+	// listing the processes, reading them, of which looking up their owners
+	// is accounted separately, and aggregating the groups.
+	stageDurations struct {
+		list, read, account, aggregate time.Duration
+	}
+
+	// scrapeResult holds the outcome of reading the processes once. It is
+	// local to a scrape, as scrapes and pushes may run concurrently.
+	scrapeResult struct {
+		// groups are sorted by account and name.
+		groups []ProcGroupResult
+		// errors is the number of errors reading processes, and timedOut
+		// whether reading stopped early because ctx was done.
+		errors   int
+		timedOut bool
+		stages   stageDurations
+		// unmatched is the number of processes no config entry matched,
+		// skipping those excluded by account, and ambiguous the number of
+		// those matching more than one with Options.CountAmbiguous.
+		unmatched int
+		ambiguous int
+		// hostProcs and hostThreads are the numbers of processes and
+		// threads on the host, before any matching.
+		hostProcs   int
+		hostThreads int
 	}
 
-	procCollector struct {
+	// ProcCollector collects metrics about groups of processes.
+	ProcCollector struct {
+		source          ProcSource
 		procfsPath      string
 		matchnamer      MatchNamer
+		matchnamerMtx   sync.RWMutex
+		opts            Options
 		collectFn       func(chan<- prometheus.Metric)
 		scrapeErrors    *prometheus.Desc
+		scrapeTimeouts  *prometheus.Desc
+		unmatchedProcs  *prometheus.Desc
+		hostProcs       *prometheus.Desc
+		hostThreads     *prometheus.Desc
+		stageDuration   *prometheus.Desc
+		procfsAvailable *prometheus.Desc
 		cpu             *prometheus.Desc
 		memory          *prometheus.Desc
+		memoryPercent   *prometheus.Desc
 		numProcs        *prometheus.Desc
 		numThreads      *prometheus.Desc
+		maxThreads      *prometheus.Desc
 		oldestStartTime *prometheus.Desc
+		oldestRunning   *prometheus.Desc
+		newestRunning   *prometheus.Desc
+		blkioDelay      *prometheus.Desc
+		majorFaults     *prometheus.Desc
+		ioSyscalls      *prometheus.Desc
+		threadsPerProc  *prometheus.Desc
+		numFds          *prometheus.Desc
+		fdLimit         *prometheus.Desc
+		fdsByType       *prometheus.Desc
+		cpuUtilization  *prometheus.Desc
+		cmdlineBytes    *prometheus.Desc
+		cmdlineMaxBytes *prometheus.Desc
+		cmdlineInfo     *prometheus.Desc
+		membersByExe    *prometheus.Desc
+		memoryQuantile  *prometheus.Desc
+		numChildren     *prometheus.Desc
+		uniqueExes      *prometheus.Desc
+		allowedCPUs     *prometheus.Desc
+		oomScore        *prometheus.Desc
+		oomScoreAdj     *prometheus.Desc
+		ambiguous       *prometheus.Desc
+		shmSegments     *prometheus.Desc
+		mappedFiles     *prometheus.Desc
+		mappedBytes     *prometheus.Desc
+		cloneSharedVM   *prometheus.Desc
+		wchan           *prometheus.Desc
+		threadStates    *prometheus.Desc
+		cwdFsUsed       *prometheus.Desc
+		cgroupMemLimit  *prometheus.Desc
 		errors          struct {
-			scrape int
+			sync.Mutex
+			scrape  int
+			timeout int
+		}
+		// legacyScrapeErrors is the name of scrapeErrors before it got
+		// the _total suffix, kept with Options.LegacyScrapeErrors.
+		legacyScrapeErrors *prometheus.Desc
+		// threadsNative holds the options of threadsPerProc as a native
+		// histogram. client_golang only builds native histograms from
+		// observations, so one is filled anew every scrape.
+		threadsNative prometheus.HistogramOpts
+		// now returns the current time, time.Now unless pinned by tests.
+		now func() time.Time
+		// bootTime caches the boot time of the source, which doesn't
+		// change, once it was read successfully.
+		bootTime struct {
+			sync.Mutex
+			value float64
+		}
+		// aggregations holds the aggregation of every family in
+		// DefaultAggregations, with the overrides of opts applied.
+		aggregations map[string]Aggregation
+		// lastCPU holds the CPU totals of the previous scrape, for
+		// computing cpuUtilization.
+		lastCPU struct {
+			sync.Mutex
+			time   time.Time
+			totals map[groupKey]float64
 		}
 	}
 )
 
-func NewProcCollector(procfsPath string, matchnamer MatchNamer) prometheus.Collector {
+// NewProcCollector returns a collector for the processes under procfsPath,
+// grouped by matchnamer. On FreeBSD the processes are read with the kern.proc
+// sysctls instead, which gives the CPU, memory, thread and start time
+// metrics, and procfsPath is only used by matchers reading files of a
+// Linux-compatible procfs.
+func NewProcCollector(procfsPath string, matchnamer MatchNamer, opts Options) *ProcCollector {
 	ns := "proc_"
 
-	return &procCollector{
-		procfsPath: procfsPath,
-		matchnamer: matchnamer,
+	// the metrics read from further procfs files aren't available
+	if !procfsMetrics {
+		opts.MemoryPercent = false
+		opts.MemorySegments = false
+		opts.AllowedCPUs = false
+		opts.OomScore = false
+		opts.IOSyscalls = false
+		opts.SharedMemory = false
+		opts.MappedFiles = false
+		opts.Wchan = false
+		opts.FdTypes = false
+		opts.CwdFilesystem = false
+		opts.CgroupMemoryLimit = false
+		opts.CloneSharedVM = false
+		opts.ThreadStates = false
+		opts.CPUByThreadRole = false
+		opts.NoFds = true
+	}
+
+	aggregations := make(map[string]Aggregation, len(DefaultAggregations))
+	for family, a := range DefaultAggregations {
+		aggregations[family] = a
+	}
+	for family, a := range opts.Aggregations {
+		aggregations[family] = a
+	}
+
+	// client_golang panics on unsorted or repeated bounds
+	threadsBounds := append([]float64(nil), opts.ThreadsBuckets...)
+	sort.Float64s(threadsBounds)
+	for i := 1; i < len(threadsBounds); i++ {
+		if threadsBounds[i] == threadsBounds[i-1] {
+			threadsBounds = append(threadsBounds[:i], threadsBounds[i+1:]...)
+			i -= 1
+		}
+	}
+
+	cpuLabels := []string{"account", "groupname", "mode"}
+	if opts.CPUByThreadRole && !opts.NoThreads {
+		cpuLabels = append(cpuLabels, "threadrole")
+	}
+
+	return &ProcCollector{
+		source:       newProcSource(procfsPath),
+		procfsPath:   procfsPath,
+		matchnamer:   matchnamer,
+		opts:         opts,
+		now:          time.Now,
+		aggregations: aggregations,
 
 		scrapeErrors: prometheus.NewDesc(
-			ns+"scrape_errors",
+			ns+"scrape_errors_total",
 			"Error collecting proc metrics",
 			nil,
+			opts.ConstLabels,
+		),
+		legacyScrapeErrors: prometheus.NewDesc(
+			ns+"scrape_errors",
+			"Error collecting proc metrics. Deprecated, use proc_scrape_errors_total.",
+			nil,
+			opts.ConstLabels,
+		),
+		procfsAvailable: prometheus.NewDesc(
+			ns+"procfs_available",
+			"Whether the procfs path is a mounted procfs (1) or not (0).",
+			nil,
+			opts.ConstLabels,
+		),
+		stageDuration: newUnitDesc(
+			ns+"scrape_stage_duration_seconds",
+			"seconds",
+			"Duration of the stages of the last scrape.",
+			[]string{"stage"},
+			opts.ConstLabels,
+		),
+		unmatchedProcs: prometheus.NewDesc(
+			ns+"unmatched_procs",
+			"Number of processes no config entry matched in the last scrape.",
+			nil,
+			opts.ConstLabels,
+		),
+		hostProcs: prometheus.NewDesc(
+			ns+"host_procs",
+			"Number of processes on the host in the last scrape, matched or not.",
+			nil,
+			opts.ConstLabels,
+		),
+		hostThreads: prometheus.NewDesc(
+			ns+"host_threads",
+			"Number of threads on the host in the last scrape, matched or not.",
+			nil,
+			opts.ConstLabels,
+		),
+		scrapeTimeouts: prometheus.NewDesc(
+			ns+"scrape_timeout_total",
+			"Number of scrapes that ran into the scrape timeout and returned partial results.",
 			nil,
+			opts.ConstLabels,
 		),
-		cpu: prometheus.NewDesc(
+		cpu: newUnitDesc(
 			ns+"cpu_seconds_total",
+			"seconds",
 			"Total user CPU time spent in seconds.",
-			[]string{"account", "groupname", "mode"},
-			nil,
+			cpuLabels,
+			opts.ConstLabels,
 		),
-		memory: prometheus.NewDesc(
+		memory: newUnitDesc(
 			ns+"memory_bytes",
+			"bytes",
 			"Used amount of memory in bytes.",
 			[]string{"account", "groupname", "memtype"},
-			nil,
+			opts.ConstLabels,
+		),
+		memoryPercent: prometheus.NewDesc(
+			ns+"memory_percent",
+			"Resident memory as a percentage of total host memory.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
 		),
 		numProcs: prometheus.NewDesc(
 			ns+"num_procs",
 			"Number of processes.",
 			[]string{"account", "groupname"},
-			nil,
+			opts.ConstLabels,
 		),
 		numThreads: prometheus.NewDesc(
 			ns+"num_threads",
 			"Number of threads.",
 			[]string{"account", "groupname"},
-			nil,
+			opts.ConstLabels,
+		),
+		maxThreads: prometheus.NewDesc(
+			ns+"max_threads_per_process",
+			"Highest number of threads of a single process.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
 		),
-		oldestStartTime: prometheus.NewDesc(
+		// Start times are timestamps, exposed as gauges like
+		// process_start_time_seconds of the client libraries, so that
+		// time() - proc_oldest_start_time_seconds works as expected.
+		oldestStartTime: newUnitDesc(
 			ns+"oldest_start_time_seconds",
+			"seconds",
 			"Oldest process start time in seconds.",
 			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		oldestRunning: newUnitDesc(
+			ns+"oldest_running_seconds",
+			"seconds",
+			"Time in seconds since the oldest process started.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		newestRunning: newUnitDesc(
+			ns+"newest_running_seconds",
+			"seconds",
+			"Time in seconds since the newest process started.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		majorFaults: prometheus.NewDesc(
+			ns+"major_page_faults_total",
+			"Number of page faults that required reading from disk.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		blkioDelay: newUnitDesc(
+			ns+"delayacct_blkio_seconds_total",
+			"seconds",
+			"Total time spent waiting for block IO in seconds, from delay accounting.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		ioSyscalls: prometheus.NewDesc(
+			ns+"io_syscalls_total",
+			"Total number of read and write syscalls.",
+			[]string{"account", "groupname", "syscalltype"},
+			opts.ConstLabels,
+		),
+		threadsPerProc: prometheus.NewDesc(
+			ns+"threads_per_process",
+			"Distribution of the number of threads of the processes in a group.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		threadsNative: prometheus.HistogramOpts{
+			Name:                        ns + "threads_per_process",
+			Help:                        "Distribution of the number of threads of the processes in a group.",
+			ConstLabels:                 opts.ConstLabels,
+			Buckets:                     threadsBounds,
+			NativeHistogramBucketFactor: nativeBucketFactor,
+		},
+		fdsByType: prometheus.NewDesc(
+			ns+"fds_by_type",
+			"Number of open file descriptors by type.",
+			[]string{"account", "groupname", "fdtype"},
+			opts.ConstLabels,
+		),
+		numFds: prometheus.NewDesc(
+			ns+"num_fds",
+			"Number of open file descriptors.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		fdLimit: prometheus.NewDesc(
+			ns+"fd_limit",
+			"Lowest soft limit on open file descriptors of the processes in a group.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		cpuUtilization: prometheus.NewDesc(
+			ns+"cpu_utilization",
+			"CPU time used since the previous scrape as a fraction of one core.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		cmdlineBytes: newUnitDesc(
+			ns+"cmdline_bytes",
+			"bytes",
+			"Total size of the command lines in bytes.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		cmdlineMaxBytes: newUnitDesc(
+			ns+"cmdline_max_bytes",
+			"bytes",
+			"Size of the largest command line in bytes.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		cmdlineInfo: prometheus.NewDesc(
+			ns+"cmdline_info",
+			"Command line of the oldest process, with a constant value of 1.",
+			[]string{"account", "groupname", "cmdline"},
+			opts.ConstLabels,
+		),
+		membersByExe: prometheus.NewDesc(
+			ns+"members_by_exe",
+			"Number of processes per executable, for the most common ones and \"other\".",
+			[]string{"account", "groupname", "exe"},
+			opts.ConstLabels,
+		),
+		memoryQuantile: prometheus.NewDesc(
+			ns+"memory_bytes_quantile",
+			"Distribution of the resident memory of the processes in a group.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		numChildren: prometheus.NewDesc(
+			ns+"num_children",
+			"Number of processes whose parent is a process of the group.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		uniqueExes: prometheus.NewDesc(
+			ns+"unique_exes",
+			"Number of distinct executable basenames in a group.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		allowedCPUs: prometheus.NewDesc(
+			ns+"allowed_cpus",
+			"Lowest number of CPUs a process of the group may run on.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		oomScore: prometheus.NewDesc(
+			ns+"oom_score",
+			"Highest OOM killer score of the processes in a group.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		oomScoreAdj: prometheus.NewDesc(
+			ns+"oom_score_adj",
+			"Lowest OOM killer score adjustment of the processes in a group.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		ambiguous: prometheus.NewDesc(
+			ns+"ambiguous_procs",
+			"Number of processes matching more than one config entry in the last scrape.",
 			nil,
+			opts.ConstLabels,
+		),
+		shmSegments: prometheus.NewDesc(
+			ns+"shm_segments",
+			"Number of System V and POSIX shared memory segments mapped.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		mappedFiles: prometheus.NewDesc(
+			ns+"mapped_files",
+			"Number of distinct files memory-mapped by each process, summed up.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		mappedBytes: newUnitDesc(
+			ns+"mapped_bytes",
+			"bytes",
+			"Size of the memory mappings backed by files.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		cloneSharedVM: prometheus.NewDesc(
+			ns+"clone_shared_vm",
+			"Number of processes sharing their virtual memory with another process of the group.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		cwdFsUsed: newUnitDesc(
+			ns+"cwd_fs_used_bytes",
+			"bytes",
+			"Used space of the filesystems holding the working directories, each counted once.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		cgroupMemLimit: newUnitDesc(
+			ns+"cgroup_memory_limit_bytes",
+			"bytes",
+			"Memory limit of the cgroups of the processes, each counted once. +Inf if any is unlimited.",
+			[]string{"account", "groupname"},
+			opts.ConstLabels,
+		),
+		threadStates: prometheus.NewDesc(
+			ns+"thread_states",
+			"Number of threads in each scheduler state.",
+			[]string{"account", "groupname", "state"},
+			opts.ConstLabels,
+		),
+		wchan: prometheus.NewDesc(
+			ns+"wchan_processes",
+			"Number of processes sleeping in a kernel function.",
+			[]string{"account", "groupname", "wchan"},
+			opts.ConstLabels,
 		),
 	}
 }
 
+// newUnitDesc is prometheus.NewDesc for a metric in unit, which its name ends
+// in. OpenMetrics expositions declare the unit in a # UNIT line.
+func newUnitDesc(fqName, unit, help string, variableLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.V2.NewDesc(fqName, help, prometheus.UnconstrainedLabels(variableLabels), constLabels, prometheus.WithUnit(unit))
+}
+
 // Describe returns all descriptions of the collector.
-func (c *procCollector) Describe(ch chan<- *prometheus.Desc) {
+func (c *ProcCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.scrapeErrors
+	if c.opts.LegacyScrapeErrors {
+		ch <- c.legacyScrapeErrors
+	}
+	ch <- c.scrapeTimeouts
+	ch <- c.unmatchedProcs
+	ch <- c.hostProcs
+	ch <- c.hostThreads
+	ch <- c.stageDuration
+	if procfsMetrics {
+		ch <- c.procfsAvailable
+	}
 	ch <- c.cpu
 	ch <- c.memory
+	if c.opts.MemoryPercent {
+		ch <- c.memoryPercent
+	}
 	ch <- c.numProcs
-	ch <- c.numThreads
-	ch <- c.oldestStartTime
+	if !c.opts.NoThreads {
+		ch <- c.numThreads
+		ch <- c.maxThreads
+		if len(c.opts.ThreadsBuckets) > 0 || c.opts.NativeHistograms {
+			ch <- c.threadsPerProc
+		}
+		if c.opts.ThreadStates {
+			ch <- c.threadStates
+		}
+	}
+	if !c.opts.NoStartTime {
+		ch <- c.oldestStartTime
+		ch <- c.oldestRunning
+		ch <- c.newestRunning
+	}
+	ch <- c.majorFaults
+	if procfsMetrics {
+		ch <- c.blkioDelay
+	}
+	if c.opts.IOSyscalls {
+		ch <- c.ioSyscalls
+	}
+	if !c.opts.NoFds {
+		ch <- c.numFds
+		if c.opts.FdLimit {
+			ch <- c.fdLimit
+		}
+		if c.opts.FdTypes {
+			ch <- c.fdsByType
+		}
+	}
+	if c.opts.CPUUtilization {
+		ch <- c.cpuUtilization
+	}
+	ch <- c.cmdlineBytes
+	ch <- c.cmdlineMaxBytes
+	if c.opts.CmdlineInfo {
+		ch <- c.cmdlineInfo
+	}
+	if c.opts.MembersByExe > 0 {
+		ch <- c.membersByExe
+	}
+	if len(c.opts.MemoryQuantiles) > 0 {
+		ch <- c.memoryQuantile
+	}
+	ch <- c.numChildren
+	ch <- c.uniqueExes
+	if c.opts.AllowedCPUs {
+		ch <- c.allowedCPUs
+	}
+	if c.opts.OomScore {
+		ch <- c.oomScore
+		ch <- c.oomScoreAdj
+	}
+	if c.opts.CountAmbiguous {
+		ch <- c.ambiguous
+	}
+	if c.opts.SharedMemory {
+		ch <- c.shmSegments
+	}
+	if c.opts.MappedFiles {
+		ch <- c.mappedFiles
+		ch <- c.mappedBytes
+	}
+	if c.opts.CloneSharedVM {
+		ch <- c.cloneSharedVM
+	}
+	if c.opts.Wchan {
+		ch <- c.wchan
+	}
+	if c.opts.CwdFilesystem {
+		ch <- c.cwdFsUsed
+	}
+	if c.opts.CgroupMemoryLimit {
+		ch <- c.cgroupMemLimit
+	}
 }
 
 // Collect returns the current state of all metrics of the collector.
-func (c *procCollector) Collect(ch chan<- prometheus.Metric) {
-	procGroups, _ := c.readProcGroups()
+func (c *ProcCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(context.Background(), ch, "")
+}
+
+// groupCollector is a view of a ProcCollector restricted to one group name,
+// or to none if empty, that stops reading processes once ctx is done.
+type groupCollector struct {
+	*ProcCollector
+	ctx   context.Context
+	group string
+}
+
+// Collect returns the current state of the metrics of the group.
+func (c groupCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(c.ctx, ch, c.group)
+}
+
+// ForGroup returns a collector emitting only the series of the named group,
+// for debugging a single group on hosts where a full scrape is heavy. It
+// shares its state with c.
+func (c *ProcCollector) ForGroup(group string) prometheus.Collector {
+	return c.ForContext(context.Background(), group)
+}
+
+// ForContext is like ForGroup, and all groups are emitted if group is empty.
+// Once ctx is done, the collector stops reading processes and emits the
+// groups read so far, as with Options.ScrapeTimeout. It allows bounding a
+// scrape by the deadline of its request.
+func (c *ProcCollector) ForContext(ctx context.Context, group string) prometheus.Collector {
+	return groupCollector{c, ctx, group}
+}
+
+// collect emits the metrics of the groups named group, or of all groups if
+// group is empty. Reading processes stops when ctx is done or the scrape
+// timeout expires.
+func (c *ProcCollector) collect(ctx context.Context, ch chan<- prometheus.Metric, group string) {
+	if c.opts.ScrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.ScrapeTimeout)
+		defer cancel()
+	}
+	scrape, err := c.snapshot(ctx)
+	procGroups := scrape.groups
+	now := float64(c.now().UnixNano()) / 1e9
+
+	var memTotal uint64
+	if c.opts.MemoryPercent {
+		var err error
+		memTotal, err = readMemTotal(c.procfsPath)
+		if err != nil {
+			c.errors.Lock()
+			c.errors.scrape += 1
+			c.errors.Unlock()
+		}
+	}
+
+	// the totals of a partial scrape lack the groups not read, which would
+	// show up as a spike in the next one
+	if c.opts.CPUUtilization && err == nil && !scrape.timedOut {
+		c.collectCPUUtilization(ch, procGroups, group)
+	}
+
+	var threadsNative *prometheus.HistogramVec
+	if c.opts.NativeHistograms && !c.opts.NoThreads {
+		threadsNative = prometheus.NewHistogramVec(c.threadsNative, []string{"account", "groupname"})
+	}
+	for _, g := range procGroups {
+		if group != "" && g.Name != group {
+			continue
+		}
+		if c.opts.CPUByThreadRole && !c.opts.NoThreads {
+			ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, g.MainCPUSystem, g.Account, g.Name, "system", "main")
+			ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, g.MainCPUUser, g.Account, g.Name, "user", "main")
+			ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, math.Max(0, g.CPUSystem-g.MainCPUSystem), g.Account, g.Name, "system", "worker")
+			ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, math.Max(0, g.CPUUser-g.MainCPUUser), g.Account, g.Name, "user", "worker")
+		} else {
+			ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, g.CPUSystem, g.Account, g.Name, "system")
+			ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, g.CPUUser, g.Account, g.Name, "user")
+		}
+		ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, g.MemVirt, g.Account, g.Name, "virtual")
+		ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, g.MemRss, g.Account, g.Name, "resident")
+		if c.opts.MemorySegments {
+			ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, g.MemStack, g.Account, g.Name, "stack")
+			ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, g.MemData, g.Account, g.Name, "data")
+			ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, g.MemText, g.Account, g.Name, "text")
+			ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, g.MemLib, g.Account, g.Name, "lib")
+		}
+		if memTotal > 0 {
+			ch <- prometheus.MustNewConstMetric(c.memoryPercent, prometheus.GaugeValue, 100*g.MemRss/float64(memTotal), g.Account, g.Name)
+		}
+		ch <- prometheus.MustNewConstMetric(c.numProcs, prometheus.GaugeValue, float64(g.NumProcs), g.Account, g.Name)
+		if !c.opts.NoThreads {
+			ch <- prometheus.MustNewConstMetric(c.numThreads, prometheus.GaugeValue, float64(g.NumThreads), g.Account, g.Name)
+			ch <- prometheus.MustNewConstMetric(c.maxThreads, prometheus.GaugeValue, float64(g.MaxThreads), g.Account, g.Name)
+			if threadsNative != nil {
+				h := threadsNative.WithLabelValues(g.Account, g.Name)
+				for _, n := range g.threadCounts {
+					h.Observe(n)
+				}
+			} else if len(c.opts.ThreadsBuckets) > 0 {
+				ch <- prometheus.MustNewConstHistogram(c.threadsPerProc, g.NumProcs, float64(g.NumThreads), g.ThreadsBuckets, g.Account, g.Name)
+			}
+			for state, n := range g.ThreadStates {
+				ch <- prometheus.MustNewConstMetric(c.threadStates, prometheus.GaugeValue, float64(n), g.Account, g.Name, state)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.numChildren, prometheus.GaugeValue, float64(g.NumChildren), g.Account, g.Name)
+		ch <- prometheus.MustNewConstMetric(c.uniqueExes, prometheus.GaugeValue, float64(g.UniqueExes), g.Account, g.Name)
+		if c.opts.AllowedCPUs && g.AllowedCPUs != 0 {
+			ch <- prometheus.MustNewConstMetric(c.allowedCPUs, prometheus.GaugeValue, g.AllowedCPUs, g.Account, g.Name)
+		}
+		if c.opts.OomScore {
+			ch <- prometheus.MustNewConstMetric(c.oomScore, prometheus.GaugeValue, g.OomScore, g.Account, g.Name)
+			ch <- prometheus.MustNewConstMetric(c.oomScoreAdj, prometheus.GaugeValue, g.OomScoreAdj, g.Account, g.Name)
+		}
+		if c.opts.SharedMemory {
+			ch <- prometheus.MustNewConstMetric(c.shmSegments, prometheus.GaugeValue, float64(g.ShmSegments), g.Account, g.Name)
+		}
+		if c.opts.MappedFiles {
+			ch <- prometheus.MustNewConstMetric(c.mappedFiles, prometheus.GaugeValue, float64(g.MappedFiles), g.Account, g.Name)
+			ch <- prometheus.MustNewConstMetric(c.mappedBytes, prometheus.GaugeValue, float64(g.MappedBytes), g.Account, g.Name)
+		}
+		if c.opts.CloneSharedVM {
+			ch <- prometheus.MustNewConstMetric(c.cloneSharedVM, prometheus.GaugeValue, float64(g.CloneSharedVM), g.Account, g.Name)
+		}
+		if c.opts.CwdFilesystem {
+			ch <- prometheus.MustNewConstMetric(c.cwdFsUsed, prometheus.GaugeValue, g.CwdFsUsed, g.Account, g.Name)
+		}
+		if c.opts.CgroupMemoryLimit && g.memCgroups != nil {
+			ch <- prometheus.MustNewConstMetric(c.cgroupMemLimit, prometheus.GaugeValue, g.CgroupMemoryLimit, g.Account, g.Name)
+		}
+		for wchan, n := range g.WchanProcs {
+			ch <- prometheus.MustNewConstMetric(c.wchan, prometheus.GaugeValue, float64(n), g.Account, g.Name, wchan)
+		}
+		if !c.opts.NoStartTime && g.OldestStartTime != 0 {
+			ch <- prometheus.MustNewConstMetric(c.oldestStartTime, prometheus.GaugeValue, float64(g.OldestStartTime), g.Account, g.Name)
+			ch <- prometheus.MustNewConstMetric(c.oldestRunning, prometheus.GaugeValue, now-g.OldestStartTime, g.Account, g.Name)
+			ch <- prometheus.MustNewConstMetric(c.newestRunning, prometheus.GaugeValue, now-g.NewestStartTime, g.Account, g.Name)
+		}
+		ch <- prometheus.MustNewConstMetric(c.majorFaults, prometheus.CounterValue, float64(g.MajorFaults), g.Account, g.Name)
+		if procfsMetrics {
+			ch <- prometheus.MustNewConstMetric(c.blkioDelay, prometheus.CounterValue, g.BlkioDelay, g.Account, g.Name)
+		}
+		if c.opts.IOSyscalls {
+			ch <- prometheus.MustNewConstMetric(c.ioSyscalls, prometheus.CounterValue, float64(g.SyscR), g.Account, g.Name, "read")
+			ch <- prometheus.MustNewConstMetric(c.ioSyscalls, prometheus.CounterValue, float64(g.SyscW), g.Account, g.Name, "write")
+		}
+		if !c.opts.NoFds {
+			if g.fdsProcs > 0 {
+				ch <- prometheus.MustNewConstMetric(c.numFds, prometheus.GaugeValue, g.NumFds, g.Account, g.Name)
+			}
+			if c.opts.FdLimit && g.FdLimit != 0 {
+				ch <- prometheus.MustNewConstMetric(c.fdLimit, prometheus.GaugeValue, g.FdLimit, g.Account, g.Name)
+			}
+			for fdtype, n := range g.FdTypes {
+				ch <- prometheus.MustNewConstMetric(c.fdsByType, prometheus.GaugeValue, float64(n), g.Account, g.Name, fdtype)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.cmdlineBytes, prometheus.GaugeValue, float64(g.CmdlineBytes), g.Account, g.Name)
+		ch <- prometheus.MustNewConstMetric(c.cmdlineMaxBytes, prometheus.GaugeValue, float64(g.CmdlineMaxBytes), g.Account, g.Name)
+		if c.opts.CmdlineInfo {
+			ch <- prometheus.MustNewConstMetric(c.cmdlineInfo, prometheus.GaugeValue, 1, g.Account, g.Name, g.Cmdline)
+		}
+		if c.opts.MembersByExe > 0 {
+			for exe, n := range topCounts(g.ExeProcs, c.opts.MembersByExe) {
+				ch <- prometheus.MustNewConstMetric(c.membersByExe, prometheus.GaugeValue, float64(n), g.Account, g.Name, exe)
+			}
+		}
+		if len(c.opts.MemoryQuantiles) > 0 {
+			var sum float64
+			for _, v := range g.RssValues {
+				sum += v
+			}
+			ch <- prometheus.MustNewConstSummary(c.memoryQuantile, g.NumProcs, sum, quantiles(g.RssValues, c.opts.MemoryQuantiles), g.Account, g.Name)
+		}
+	}
+	if threadsNative != nil {
+		threadsNative.Collect(ch)
+	}
 
+	c.errors.Lock()
+	scrapeErrors, scrapeTimeouts := c.errors.scrape, c.errors.timeout
+	c.errors.Unlock()
+	ch <- prometheus.MustNewConstMetric(c.scrapeErrors, prometheus.CounterValue, float64(scrapeErrors))
+	if c.opts.LegacyScrapeErrors {
+		ch <- prometheus.MustNewConstMetric(c.legacyScrapeErrors, prometheus.CounterValue, float64(scrapeErrors))
+	}
+	ch <- prometheus.MustNewConstMetric(c.scrapeTimeouts, prometheus.CounterValue, float64(scrapeTimeouts))
+	ch <- prometheus.MustNewConstMetric(c.unmatchedProcs, prometheus.GaugeValue, float64(scrape.unmatched))
+	ch <- prometheus.MustNewConstMetric(c.hostProcs, prometheus.GaugeValue, float64(scrape.hostProcs))
+	ch <- prometheus.MustNewConstMetric(c.hostThreads, prometheus.GaugeValue, float64(scrape.hostThreads))
+	for stage, d := range map[string]time.Duration{
+		"list":      scrape.stages.list,
+		"read":      scrape.stages.read,
+		"account":   scrape.stages.account,
+		"aggregate": scrape.stages.aggregate,
+	} {
+		ch <- prometheus.MustNewConstMetric(c.stageDuration, prometheus.GaugeValue, d.Seconds(), stage)
+	}
+	if procfsMetrics {
+		var available float64
+		if CheckProcfs(c.procfsPath) == nil {
+			available = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.procfsAvailable, prometheus.GaugeValue, available)
+	}
+	if c.opts.CountAmbiguous {
+		ch <- prometheus.MustNewConstMetric(c.ambiguous, prometheus.GaugeValue, float64(scrape.ambiguous))
+	}
+}
+
+// collectCPUUtilization emits the CPU utilization of every group that was
+// also present in the previous scrape, and remembers the current totals.
+// Only groups named group are emitted, unless it is empty; the totals of all
+// groups are kept regardless.
+func (c *ProcCollector) collectCPUUtilization(ch chan<- prometheus.Metric, procGroups []ProcGroupResult, group string) {
+	c.lastCPU.Lock()
+	defer c.lastCPU.Unlock()
+
+	now := c.now()
+	elapsed := now.Sub(c.lastCPU.time).Seconds()
+	totals := make(map[groupKey]float64, len(procGroups))
 	for _, g := range procGroups {
-		ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, g.cpuSystem, g.account, g.name, "system")
-		ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, g.cpuUser, g.account, g.name, "user")
-		ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, float64(g.memVirt), g.account, g.name, "virtual")
-		ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, float64(g.memRss), g.account, g.name, "resident")
-		ch <- prometheus.MustNewConstMetric(c.numProcs, prometheus.GaugeValue, float64(g.numProcs), g.account, g.name)
-		ch <- prometheus.MustNewConstMetric(c.numThreads, prometheus.GaugeValue, float64(g.numThreads), g.account, g.name)
-		ch <- prometheus.MustNewConstMetric(c.oldestStartTime, prometheus.GaugeValue, float64(g.oldestStartTime), g.account, g.name)
+		gkey := groupKey{g.Account, g.Name}
+		total := g.CPUSystem + g.CPUUser
+		totals[gkey] = total
+
+		last, ok := c.lastCPU.totals[gkey]
+		// The total drops when members of the group exit.
+		if !ok || elapsed <= 0 || total < last || (group != "" && g.Name != group) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.cpuUtilization, prometheus.GaugeValue, (total-last)/elapsed, g.Account, g.Name)
+	}
+
+	c.lastCPU.time = now
+	c.lastCPU.totals = totals
+}
+
+// SetMatchNamer replaces the matchnamer of c, e.g. after the config was
+// reloaded. Scrapes in progress finish with the previous one.
+func (c *ProcCollector) SetMatchNamer(matchnamer MatchNamer) {
+	c.matchnamerMtx.Lock()
+	defer c.matchnamerMtx.Unlock()
+	c.matchnamer = matchnamer
+}
+
+// readBootTime returns the boot time of the host in seconds since the epoch.
+// It is read from the source on the first successful call and cached.
+func (c *ProcCollector) readBootTime() (float64, error) {
+	c.bootTime.Lock()
+	defer c.bootTime.Unlock()
+
+	if c.bootTime.value != 0 {
+		return c.bootTime.value, nil
+	}
+	var bootTime float64
+	err := retry("reading the boot time", func() (err error) {
+		bootTime, err = c.source.BootTime()
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
+	c.bootTime.value = bootTime
+	return c.bootTime.value, nil
+}
 
-	ch <- prometheus.MustNewConstMetric(c.scrapeErrors, prometheus.CounterValue, float64(c.errors.scrape))
+// Snapshot reads all processes and returns the matched groups, sorted by
+// account and name. It allows using the collector without a Prometheus
+// registry.
+func (c *ProcCollector) Snapshot() ([]ProcGroupResult, error) {
+	scrape, err := c.snapshot(context.Background())
+	return scrape.groups, err
 }
 
-func (c *procCollector) readProcGroups() (map[groupKey]*procGroup, error) {
+// snapshot reads and groups all processes, and adds the errors to the totals
+// of c.
+func (c *ProcCollector) snapshot(ctx context.Context) (*scrapeResult, error) {
+	scrape := &scrapeResult{}
+	procGroups, err := c.readProcGroups(ctx, scrape)
+	c.errors.Lock()
+	c.errors.scrape += scrape.errors
+	if scrape.timedOut {
+		c.errors.timeout += 1
+	}
+	c.errors.Unlock()
+	if err != nil {
+		return scrape, err
+	}
+
+	result := make([]ProcGroupResult, 0, len(procGroups))
+	for _, g := range procGroups {
+		result = append(result, *g)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Account != result[j].Account {
+			return result[i].Account < result[j].Account
+		}
+		return result[i].Name < result[j].Name
+	})
+	scrape.groups = result
+	return scrape, nil
+}
+
+// readProcGroups reads and groups all processes, and records errors and
+// stage durations in scrape. Once ctx is done, the groups of the processes
+// read so far are returned.
+func (c *ProcCollector) readProcGroups(ctx context.Context, scrape *scrapeResult) (map[groupKey]*ProcGroupResult, error) {
+	start := time.Now()
+
 	// list processes
-	procs, err := procfs.AllProcs()
+	var pids []int
+	err := retry("listing processes", func() (err error) {
+		pids, err = c.source.PIDs()
+		return err
+	})
 	if err != nil {
-		c.errors.scrape += 1
+		scrape.errors += 1
 		return nil, err
 	}
 
-	fstat, err := procfs.NewStat()
+	// without the boot time, start times are unknown and left out
+	bootTime, err := c.readBootTime()
 	if err != nil {
-		c.errors.scrape += 1
+		scrape.errors += 1
 	}
 
+	// the same matchnamer for the whole scrape, even if it is replaced
+	c.matchnamerMtx.RLock()
+	matchnamer := c.matchnamer
+	c.matchnamerMtx.RUnlock()
+
 	var (
-		bootTime   = uint64(fstat.BootTime)
-		procGroups = make(map[groupKey]*procGroup, 100)
+		procGroups = make(map[groupKey]*ProcGroupResult, 100)
+		stages     = stageDurations{list: time.Since(start)}
+		readStart  = time.Now()
+		// parents of all processes and groups of the matched ones, to
+		// count children per group
+		parents = make(map[int]int, len(pids))
+		members = make(map[int]*ProcGroupResult, len(pids))
 	)
+	// lookupOwner fills in the name of the owner of a process, which is
+	// timed as a stage of its own as it may go through NSS.
+	lookupOwner := func(nacl *NameAndCmdline) {
+		accountStart := time.Now()
+		var err error
+		if nacl.Username, err = lookupAccount(nacl.UID); err != nil {
+			scrape.errors += 1
+		}
+		stages.account += time.Since(accountStart)
+	}
+
+	for i, pid := range pids {
+		if ctx.Err() != nil {
+			scrape.timedOut = true
+			log.Warnf("Scrape timed out after reading %d of %d processes", i, len(pids))
+			break
+		}
+		if i > 0 && i%progressInterval == 0 {
+			log.Debugf("Read %d of %d processes (%d%%)", i, len(pids), 100*i/len(pids))
+		}
 
-	for _, p := range procs {
 		// read comm & cmdline
-		stat, err := p.NewStat()
+		stat, err := c.source.Stat(pid)
 		if err != nil {
-			c.errors.scrape += 1
-			continue
-		}
-		cmdline, err := p.CmdLine()
-		if err != nil {
-			c.errors.scrape += 1
+			scrape.errors += 1
 			continue
 		}
+		parents[pid] = stat.PPID
+		scrape.hostThreads += int(stat.NumThreads)
 
-		// match
-		comm := stat.Comm
-		nacl := NameAndCmdline{Name: comm, Cmdline: cmdline}
-		wanted, gname := c.matchnamer.MatchAndName(nacl)
+		// match; the owner is looked up first only to filter accounts,
+		// and after only for groups not setting their own account
+		nacl := newNameAndCmdline(c.procfsPath, stat, bootTime)
+		lookedUp := false
+		if c.opts.filtersAccounts() {
+			lookupOwner(&nacl)
+			lookedUp = true
+			if !c.opts.accountWanted(nacl.Username) {
+				continue
+			}
+		}
+		wanted, gname, account := MatchAndNameAccount(matchnamer, nacl)
 
 		if !wanted {
+			scrape.unmatched += 1
 			continue
 		}
+		if account == "" {
+			if !lookedUp {
+				lookupOwner(&nacl)
+			}
+			account = nacl.Username
+		}
+		if c.opts.CountAmbiguous {
+			if names := matchAllNames(matchnamer, nacl); len(names) > 1 {
+				scrape.ambiguous += 1
+				log.Debugf("Process %d (%s) matches several entries: %q", pid, nacl.Name, names)
+			}
+		}
 
 		// read metrics
-		account, err := getProcAccount(p.PID)
-		if err != nil {
-			c.errors.scrape += 1
+		cmdline := stat.Cmdline
+		memVirt := stat.VirtualMemory
+		memRss := stat.ResidentMemory
+		numThreads := stat.NumThreads
+		startTime := nacl.StartTime
+		var (
+			status       map[string]string
+			oomScore     int64
+			oomScoreAdj  int64
+			syscR, syscW uint64
+			numFds       int
+			fdsRead      bool
+			fdLimit      float64
+		)
+		if c.opts.MemorySegments || c.opts.AllowedCPUs {
+			status, err = readProcFields(c.procfsPath, pid, "status")
+			if err != nil {
+				scrape.errors += 1
+			}
+		}
+		if c.opts.OomScore {
+			oomScore, err = readProcInt(c.procfsPath, pid, "oom_score")
+			if err != nil {
+				scrape.errors += 1
+			}
+			oomScoreAdj, err = readProcInt(c.procfsPath, pid, "oom_score_adj")
+			if err != nil {
+				scrape.errors += 1
+			}
+		}
+		if c.opts.IOSyscalls {
+			// io of processes owned by other users can't be read unless
+			// root
+			syscR, syscW, err = readProcIO(c.procfsPath, pid)
+			if err != nil && !os.IsPermission(err) {
+				scrape.errors += 1
+			}
+		}
+		// size of /proc/<pid>/cmdline, NUL separated
+		var cmdlineBytes uint64
+		for _, arg := range cmdline {
+			cmdlineBytes += uint64(len(arg)) + 1
+		}
+		if cmdlineBytes > 0 {
+			cmdlineBytes -= 1
+		}
+		if !c.opts.NoFds {
+			// fds of processes owned by other users can't be read unless
+			// root, those are left out instead of counting as none
+			fds, err := readDirNames(filepath.Join(c.procfsPath, strconv.Itoa(pid), "fd"))
+			if err != nil && !os.IsPermission(err) {
+				scrape.errors += 1
+			}
+			numFds, fdsRead = len(fds), err == nil
+			if c.opts.FdLimit {
+				fdLimit, err = readOpenFilesLimit(c.procfsPath, pid)
+				if err != nil {
+					scrape.errors += 1
+				}
+			}
 		}
-		cpuSystem := float64(stat.STime) / userHZ
-		cpuUser := float64(stat.UTime) / userHZ
-		memVirt := uint64(stat.VirtualMemory())
-		memRss := uint64(stat.ResidentMemory())
-		numThreads := uint64(stat.NumThreads)
-		startTime := float64(bootTime) + (float64(stat.Starttime) / userHZ)
 
 		// get a group
 		gkey := groupKey{account, gname}
 		g := procGroups[gkey]
 
 		if g == nil {
-			g = &procGroup{name: gname, account: account}
+			g = &ProcGroupResult{Name: gname, Account: account, exes: make(map[string]struct{})}
+			if len(c.opts.ThreadsBuckets) > 0 && !c.opts.NativeHistograms {
+				g.ThreadsBuckets = make(map[float64]uint64, len(c.opts.ThreadsBuckets))
+				for _, b := range c.opts.ThreadsBuckets {
+					g.ThreadsBuckets[b] = 0
+				}
+			}
 			procGroups[gkey] = g
 		}
 
 		// update group
-		g.cpuSystem += cpuSystem
-		g.cpuUser += cpuUser
-		g.memVirt += memVirt
-		g.memRss += memRss
-		g.numProcs += 1
-		g.numThreads += numThreads
-		if g.oldestStartTime == 0 || startTime < g.oldestStartTime {
-			g.oldestStartTime = startTime
+		g.CPUSystem += stat.CPUSystem
+		g.CPUUser += stat.CPUUser
+		g.NumProcs += 1
+		n := g.NumProcs
+		exebase, exefull := nacl.exe()
+		if _, ok := g.exes[exebase]; !ok {
+			g.exes[exebase] = struct{}{}
+			g.UniqueExes += 1
+		}
+		if c.opts.CloneSharedVM {
+			g.pids = append(g.pids, pid)
+		}
+		if c.opts.MembersByExe > 0 {
+			if g.ExeProcs == nil {
+				g.ExeProcs = make(map[string]uint64)
+			}
+			// label values must be valid UTF-8
+			g.ExeProcs[cmdlineLabel([]string{exefull}, 0)] += 1
+		}
+		mem := c.aggregations["memory_bytes"]
+		g.MemVirt = mem.aggregate(g.MemVirt, memVirt, n)
+		g.MemRss = mem.aggregate(g.MemRss, memRss, n)
+		g.MemStack = mem.aggregate(g.MemStack, float64(statusBytes(status, "VmStk")), n)
+		g.MemData = mem.aggregate(g.MemData, float64(statusBytes(status, "VmData")), n)
+		g.MemText = mem.aggregate(g.MemText, float64(statusBytes(status, "VmExe")), n)
+		g.MemLib = mem.aggregate(g.MemLib, float64(statusBytes(status, "VmLib")), n)
+		g.OomScore = c.aggregations["oom_score"].aggregate(g.OomScore, float64(oomScore), n)
+		g.OomScoreAdj = c.aggregations["oom_score_adj"].aggregate(g.OomScoreAdj, float64(oomScoreAdj), n)
+		if fdsRead {
+			g.fdsProcs += 1
+			g.NumFds = c.aggregations["num_fds"].aggregate(g.NumFds, float64(numFds), g.fdsProcs)
+		}
+		// unknown masks and limits are left out, aggregating over the
+		// processes read only
+		if cpus := countCPUList(status["Cpus_allowed_list"]); cpus != 0 {
+			g.allowedCPUsProcs += 1
+			g.AllowedCPUs = c.aggregations["allowed_cpus"].aggregate(g.AllowedCPUs, float64(cpus), g.allowedCPUsProcs)
+		}
+		if fdLimit != 0 {
+			g.fdLimits += 1
+			g.FdLimit = c.aggregations["fd_limit"].aggregate(g.FdLimit, fdLimit, g.fdLimits)
+		}
+		g.NumThreads += numThreads
+		if numThreads > g.MaxThreads {
+			g.MaxThreads = numThreads
+		}
+		g.BlkioDelay += stat.BlkioDelay
+		g.MajorFaults += stat.MajorFaults
+		g.SyscR += syscR
+		g.SyscW += syscW
+		for b := range g.ThreadsBuckets {
+			if float64(numThreads) <= b {
+				g.ThreadsBuckets[b] += 1
+			}
+		}
+		if c.opts.NativeHistograms {
+			g.threadCounts = append(g.threadCounts, float64(numThreads))
+		}
+		if bootTime != 0 && (g.OldestStartTime == 0 || startTime < g.OldestStartTime) {
+			g.OldestStartTime = startTime
+		}
+		if bootTime != 0 && startTime > g.NewestStartTime {
+			g.NewestStartTime = startTime
+		}
+		g.CmdlineBytes += cmdlineBytes
+		if len(c.opts.MemoryQuantiles) > 0 {
+			g.RssValues = append(g.RssValues, memRss)
+		}
+		if cmdlineBytes > g.CmdlineMaxBytes {
+			g.CmdlineMaxBytes = cmdlineBytes
+		}
+		if c.opts.CmdlineInfo && (g.NumProcs == 1 || startTime < g.cmdlineStart ||
+			startTime == g.cmdlineStart && pid < g.cmdlinePID) {
+			g.Cmdline = cmdlineLabel(cmdline, c.opts.CmdlineInfoMaxLength)
+			g.cmdlinePID = pid
+			g.cmdlineStart = startTime
+		}
+		if c.opts.SharedMemory || c.opts.MappedFiles {
+			// maps of processes owned by other users can't be read unless root
+			maps, err := readMaps(c.procfsPath, pid)
+			if err != nil && !os.IsPermission(err) {
+				scrape.errors += 1
+			}
+			g.ShmSegments += maps.shmSegments
+			g.MappedFiles += maps.files
+			g.MappedBytes += maps.bytes
+		}
+		if c.opts.FdTypes && !c.opts.NoFds {
+			// fds of processes owned by other users can't be read unless
+			// root
+			targets, err := fdTargets(nacl)
+			if err != nil && !os.IsPermission(err) && !os.IsNotExist(err) {
+				scrape.errors += 1
+			}
+			for _, target := range targets {
+				if g.FdTypes == nil {
+					g.FdTypes = make(map[string]uint64)
+				}
+				g.FdTypes[fdType(target)] += 1
+			}
+		}
+		if c.opts.CPUByThreadRole && !c.opts.NoThreads {
+			user, system, err := readMainThreadCPU(c.procfsPath, pid)
+			if err != nil && !os.IsNotExist(err) {
+				scrape.errors += 1
+			}
+			g.MainCPUUser += user
+			g.MainCPUSystem += system
+		}
+		if c.opts.ThreadStates && !c.opts.NoThreads {
+			// tasks of processes owned by other users can be listed, so
+			// errors are real ones
+			states, err := readThreadStates(c.procfsPath, pid)
+			if err != nil && !os.IsNotExist(err) {
+				scrape.errors += 1
+			}
+			for state, n := range states {
+				if g.ThreadStates == nil {
+					g.ThreadStates = make(map[string]uint64)
+				}
+				g.ThreadStates[state] += n
+			}
+		}
+		if c.opts.Wchan {
+			// "0" for running processes, and for all when kernel
+			// symbols are hidden from the exporter
+			wchan, err := ioutil.ReadFile(filepath.Join(c.procfsPath, strconv.Itoa(pid), "wchan"))
+			if err == nil && len(wchan) > 0 && string(wchan) != "0" {
+				if g.WchanProcs == nil {
+					g.WchanProcs = make(map[string]uint64)
+				}
+				g.WchanProcs[string(wchan)] += 1
+			}
+		}
+		if c.opts.CwdFilesystem {
+			// the cwd of processes owned by other users can't be read
+			// unless root
+			var st syscall.Statfs_t
+			if err := syscall.Statfs(filepath.Join(c.procfsPath, strconv.Itoa(pid), "cwd"), &st); err == nil {
+				fsKey := fmt.Sprint(st.Type, st.Fsid)
+				if _, ok := g.cwdFs[fsKey]; !ok {
+					if g.cwdFs == nil {
+						g.cwdFs = make(map[string]struct{})
+					}
+					g.cwdFs[fsKey] = struct{}{}
+					g.CwdFsUsed += float64(st.Blocks-st.Bfree) * float64(st.Bsize)
+				}
+			} else if !os.IsPermission(err) && !os.IsNotExist(err) {
+				scrape.errors += 1
+			}
+		}
+		if c.opts.CgroupMemoryLimit {
+			file, err := memoryLimitFile(c.procfsPath, c.opts.CgroupfsPath, pid)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					scrape.errors += 1
+				}
+			} else if _, ok := g.memCgroups[file]; file != "" && !ok {
+				// the root cgroup has no limit file, and so no limit
+				limit, err := readMemoryLimit(file)
+				if err == nil {
+					if g.memCgroups == nil {
+						g.memCgroups = make(map[string]struct{})
+					}
+					g.memCgroups[file] = struct{}{}
+					g.CgroupMemoryLimit += limit
+				} else if !os.IsNotExist(err) {
+					scrape.errors += 1
+				}
+			}
+		}
+		members[pid] = g
+	}
+	stages.read = time.Since(readStart) - stages.account
+
+	aggregateStart := time.Now()
+	for _, ppid := range parents {
+		if g := members[ppid]; g != nil {
+			g.NumChildren += 1
+		}
+	}
+	if c.opts.CloneSharedVM {
+		for _, g := range procGroups {
+			g.CloneSharedVM = countSharedVM(g.pids)
 		}
 	}
+	stages.aggregate = time.Since(aggregateStart)
 
+	scrape.stages = stages
+	scrape.hostProcs = len(pids)
 	return procGroups, nil
 }
 
-func getProcAccount(pid int) (string, error) {
-	fi, err := os.Stat(fmt.Sprintf("/proc/%d/stat", pid))
+// cmdlineLabel joins cmdline with spaces and truncates it to max
+// characters, unless max is zero. Invalid UTF-8 is replaced, as label values
+// must be valid.
+func cmdlineLabel(cmdline []string, max int) string {
+	r := []rune(strings.Join(cmdline, " "))
+	if max > 0 && len(r) > max {
+		r = r[:max]
+	}
+	return string(r)
+}
+
+// topCounts returns the n largest counts, ties going to the lower key, and
+// the sum of the others as "other".
+func topCounts(counts map[string]uint64, n int) map[string]uint64 {
+	if len(counts) <= n {
+		return counts
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	top := make(map[string]uint64, n+1)
+	for i, k := range keys {
+		if i < n {
+			top[k] = counts[k]
+		} else {
+			top["other"] += counts[k]
+		}
+	}
+	return top
+}
+
+// quantiles returns the nearest-rank quantiles qs of values. values is
+// sorted in place.
+func quantiles(values []float64, qs []float64) map[float64]float64 {
+	sort.Float64s(values)
+	result := make(map[float64]float64, len(qs))
+	for _, q := range qs {
+		if len(values) == 0 {
+			result[q] = math.NaN()
+			continue
+		}
+		i := int(math.Ceil(q*float64(len(values)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		result[q] = values[i]
+	}
+	return result
+}
+
+// retry calls fn until it succeeds or retryCount retries have failed, and
+// returns the last error.
+func retry(what string, fn func() error) error {
+	backoff := retryBackoff
+	err := fn()
+	for i := 0; err != nil && i < retryCount; i++ {
+		log.Debugf("Error %s, retrying in %v: %v", what, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+// MatchProcs runs matchnamer against every process once and reports the
+// result per process, without collecting any metrics. It is meant for
+// checking a config against the processes of the current host.
+func MatchProcs(procfsPath string, matchnamer MatchNamer) ([]ProcMatch, error) {
+	source := newProcSource(procfsPath)
+	pids, err := source.PIDs()
+	if err != nil {
+		return nil, err
+	}
+	bootTime, err := source.BootTime()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ProcMatch
+	for _, pid := range pids {
+		stat, err := source.Stat(pid)
+		if err != nil {
+			continue
+		}
+
+		nacl := newNameAndCmdline(procfsPath, stat, bootTime)
+		nacl.Username, _ = lookupAccount(nacl.UID)
+		pm := ProcMatch{NameAndCmdline: nacl}
+		if matchnamer != nil {
+			pm.Matched, pm.GroupName = matchnamer.MatchAndName(pm.NameAndCmdline)
+		}
+		result = append(result, pm)
+	}
+	return result, nil
+}
+
+// newNameAndCmdline builds the matcher input of a process. The name of the
+// owner is left empty, for callers to look it up only if they need it.
+func newNameAndCmdline(procfsPath string, stat ProcStat, bootTime float64) NameAndCmdline {
+	var startTime float64
+	if bootTime != 0 {
+		startTime = bootTime + stat.StartTime
+	}
+	return NameAndCmdline{
+		Name:       stat.Comm,
+		Cmdline:    stat.Cmdline,
+		UID:        stat.UID,
+		TTY:        stat.TTY,
+		PID:        stat.PID,
+		SID:        stat.SID,
+		PGID:       stat.PGID,
+		StartTime:  startTime,
+		procfsPath: procfsPath,
+	}
+}
+
+// threadStateNames are the names of the state letters of
+// /proc/<pid>/task/<tid>/stat, as printed by ps.
+var threadStateNames = map[byte]string{
+	'R': "running",
+	'S': "sleeping",
+	'D': "disk_sleep",
+	'T': "stopped",
+	't': "tracing_stop",
+	'Z': "zombie",
+	'X': "dead",
+	'I': "idle",
+}
+
+// readThreadStates counts the threads of a process by scheduler state.
+// Threads exiting while reading are skipped, unknown states are kept by
+// their letter.
+func readThreadStates(procfsPath string, pid int) (map[string]uint64, error) {
+	taskDir := filepath.Join(procfsPath, strconv.Itoa(pid), "task")
+	tids, err := readDirNames(taskDir)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]uint64)
+	for _, tid := range tids {
+		data, err := ioutil.ReadFile(filepath.Join(taskDir, tid, "stat"))
+		if err != nil {
+			continue
+		}
+		// the state follows the parenthesized comm, which may contain
+		// spaces and parentheses itself
+		r := bytes.LastIndex(data, []byte(")"))
+		if r < 0 || r+2 >= len(data) {
+			continue
+		}
+		state, ok := threadStateNames[data[r+2]]
+		if !ok {
+			state = string(data[r+2])
+		}
+		states[state] += 1
+	}
+	return states, nil
+}
+
+// readMainThreadCPU returns the user and system CPU time in seconds of the
+// main thread of a process, whose TID is the PID, from
+// /proc/<pid>/task/<pid>/stat.
+func readMainThreadCPU(procfsPath string, pid int) (float64, float64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procfsPath, strconv.Itoa(pid), "task", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	// the fields following the parenthesized comm start with the state,
+	// utime and stime are the 12th and 13th of them
+	r := bytes.LastIndex(data, []byte(")"))
+	if r < 0 {
+		return 0, 0, fmt.Errorf("unexpected stat content %q", data)
+	}
+	fields := strings.Fields(string(data[r+1:]))
+	if len(fields) < 13 {
+		return 0, 0, fmt.Errorf("unexpected stat content %q", data)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return float64(utime) / userHZ, float64(stime) / userHZ, nil
+}
+
+// memoryLimitFile returns the path of the memory limit file of the memory
+// cgroup of a process under cgroupfsPath, or an empty string if it has none.
+// The v1 memory controller is preferred on hosts mounting both hierarchies,
+// as it is the one limiting.
+func memoryLimitFile(procfsPath, cgroupfsPath string, pid int) (string, error) {
+	if cgroupfsPath == "" {
+		cgroupfsPath = "/sys/fs/cgroup"
+	}
+	data, err := ioutil.ReadFile(filepath.Join(procfsPath, strconv.Itoa(pid), "cgroup"))
 	if err != nil {
-		fmt.Println(fmt.Errorf("Stat error for %d: %v", pid, err))
 		return "", err
 	}
 
-	fstat, ok := fi.Sys().(*syscall.Stat_t)
+	var unified string
+	for _, line := range strings.Split(string(data), "\n") {
+		// hierarchy-ID:controller-list:cgroup-path, where the unified
+		// hierarchy of v2 has ID 0 and no controllers
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			unified = parts[2]
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "memory" {
+				return filepath.Join(cgroupfsPath, "memory", parts[2], "memory.limit_in_bytes"), nil
+			}
+		}
+	}
+	if unified == "" {
+		return "", nil
+	}
+	return filepath.Join(cgroupfsPath, unified, "memory.max"), nil
+}
+
+// readMemoryLimit returns the limit in a memory.max or memory.limit_in_bytes
+// file, +Inf for unlimited cgroups.
+func readMemoryLimit(file string) (float64, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return math.Inf(1), nil
+	}
+	limit, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	// v1 has no "max", unlimited cgroups report the largest multiple of
+	// the page size, 9223372036854771712 with 4k pages
+	if limit >= 1<<62 {
+		return math.Inf(1), nil
+	}
+	return float64(limit), nil
+}
+
+// readProcInt returns the content of a /proc/<pid> file holding a single
+// integer, such as oom_score.
+func readProcInt(procfsPath string, pid int, name string) (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procfsPath, strconv.Itoa(pid), name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// mapsInfo summarizes the memory mappings of a process.
+type mapsInfo struct {
+	// shmSegments is the number of distinct shared memory segments, i.e.
+	// System V segments, which show up as /SYSV<key>, and POSIX ones under
+	// /dev/shm.
+	shmSegments uint64
+	// files is the number of distinct files mapped, and bytes the summed
+	// size of their mappings.
+	files uint64
+	bytes uint64
+}
+
+// readMaps returns the summary of /proc/<pid>/maps.
+func readMaps(procfsPath string, pid int) (mapsInfo, error) {
+	f, err := os.Open(filepath.Join(procfsPath, strconv.Itoa(pid), "maps"))
+	if err != nil {
+		return mapsInfo{}, err
+	}
+	defer f.Close()
+	return parseMaps(f)
+}
+
+// parseMaps summarizes maps content.
+func parseMaps(r io.Reader) (mapsInfo, error) {
+	var info mapsInfo
+	segments := make(map[string]struct{})
+	files := make(map[string]struct{})
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.SplitN(s.Text(), " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+		path := strings.TrimSpace(fields[5])
+		if strings.HasPrefix(path, "/SYSV") || strings.HasPrefix(path, "/dev/shm/") {
+			segments[path] = struct{}{}
+		}
+		// Anonymous mappings have inode 0, and pseudo paths like [heap]
+		// don't start with a slash.
+		if fields[4] == "0" || !strings.HasPrefix(path, "/") {
+			continue
+		}
+		files[path] = struct{}{}
+		addrs := strings.SplitN(fields[0], "-", 2)
+		if len(addrs) != 2 {
+			continue
+		}
+		start, err := strconv.ParseUint(addrs[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		end, err := strconv.ParseUint(addrs[1], 16, 64)
+		if err != nil || end < start {
+			continue
+		}
+		info.bytes += end - start
+	}
+	info.shmSegments = uint64(len(segments))
+	info.files = uint64(len(files))
+	return info, s.Err()
+}
+
+// fileID returns the device and inode of a file.
+func fileID(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
 	if !ok {
-		fmt.Println(fmt.Errorf("Stat_t is not available for %d: %v", pid, err))
-		return "", err
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), true
+}
+
+// readProcFields returns the "name: value" fields of a /proc/<pid> file like
+// status or io by name.
+func readProcFields(procfsPath string, pid int, file string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(procfsPath, strconv.Itoa(pid), file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	status := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), ":", 2)
+		if len(kv) == 2 {
+			status[kv[0]] = strings.TrimSpace(kv[1])
+		}
 	}
+	return status, s.Err()
+}
 
-	account, err := user.LookupId(fmt.Sprint(fstat.Uid))
+// readProcIO returns the number of read and write syscalls of a process from
+// /proc/<pid>/io.
+func readProcIO(procfsPath string, pid int) (uint64, uint64, error) {
+	io, err := readProcFields(procfsPath, pid, "io")
 	if err != nil {
-		fmt.Println(fmt.Errorf("User lookup error for %d: %v", pid, err))
-		return "", err
+		return 0, 0, err
+	}
+	syscR, err := strconv.ParseUint(io["syscr"], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	syscW, err := strconv.ParseUint(io["syscw"], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return syscR, syscW, nil
+}
+
+// statusBytes returns the named size field of a process status in bytes, or
+// 0 if it is missing, as for kernel threads.
+func statusBytes(status map[string]string, name string) uint64 {
+	fields := strings.Fields(status[name])
+	if len(fields) != 2 || fields[1] != "kB" {
+		return 0
+	}
+	kb, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return kb * 1024
+}
+
+// countCPUList returns the number of CPUs in a list like 0-3,8,12-15, as in
+// Cpus_allowed_list of /proc/<pid>/status. It returns 0 for malformed lists.
+func countCPUList(list string) int {
+	if list == "" {
+		return 0
+	}
+
+	var count int
+	for _, r := range strings.Split(list, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		min, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return 0
+		}
+		max := min
+		if len(bounds) == 2 {
+			max, err = strconv.Atoi(bounds[1])
+			if err != nil || max < min {
+				return 0
+			}
+		}
+		count += max - min + 1
+	}
+	return count
+}
+
+// readMemTotal returns the total usable host memory in bytes, as reported by
+// the MemTotal line of meminfo under procfsPath.
+func readMemTotal(procfsPath string) (uint64, error) {
+	f, err := os.Open(filepath.Join(procfsPath, "meminfo"))
+	if err != nil {
+		return 0, err
 	}
+	defer f.Close()
 
-	return account.Username, nil
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("couldn't parse MemTotal %q: %v", fields[1], err)
+		}
+		return kb * 1024, nil
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no MemTotal in %s", f.Name())
 }
@@ -0,0 +1,218 @@
+//go:build freebsd && amd64
+// +build freebsd,amd64
+
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Offsets into struct kinfo_proc of FreeBSD amd64, from sys/user.h. The
+// layout is kept stable across releases, which the size in its first field
+// guards.
+const (
+	kinfoProcSize = 1088
+	kiPid         = 72
+	kiPpid        = 76
+	kiPgid        = 80
+	kiSid         = 88
+	kiTdev        = 100
+	kiUid         = 168
+	kiSize        = 256
+	kiRssize      = 264
+	kiStart       = 336
+	kiComm        = 447
+	kiCommLen     = 20
+	kiNumthreads  = 596
+	// ki_rusage starts with ru_utime and ru_stime, both struct timeval.
+	kiRusage = 608
+	// ru_majflt of ki_rusage
+	kiMajflt = kiRusage + 72
+
+	// noDev is the ki_tdev of processes without a controlling terminal.
+	noDev = 0xffffffff
+
+	// procfsMetrics tells whether the metrics read from further files of
+	// a process under the procfs path are available, which they aren't
+	// without a Linux procfs.
+	procfsMetrics = false
+)
+
+// kinfoSource reads processes with the kern.proc sysctls. kern.proc.proc
+// returns all processes at once, so PIDs keeps them for Stat, along with the
+// boot time their start times are relative to.
+type kinfoSource struct {
+	mtx      sync.Mutex
+	procs    map[int]kinfoProc
+	bootTime float64
+}
+
+// kinfoProc holds the fields of a struct kinfo_proc the collector uses.
+type kinfoProc struct {
+	pid, ppid, pgid, sid int
+	tty                  int
+	uid                  int
+	comm                 string
+	virt, rss            float64
+	user, system         float64
+	start                float64
+	threads              uint64
+	majorFaults          uint64
+}
+
+// newProcSource returns the ProcSource of the platform. procfsPath is only
+// used by matchers reading files of a Linux-compatible procfs.
+func newProcSource(procfsPath string) ProcSource {
+	return &kinfoSource{}
+}
+
+// PIDs reads all processes with kern.proc.proc and keeps them for Stat.
+func (s *kinfoSource) PIDs() ([]int, error) {
+	bootTime, err := s.BootTime()
+	if err != nil {
+		return nil, err
+	}
+	procs, err := readKinfoProcs()
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, 0, len(procs))
+	byPID := make(map[int]kinfoProc, len(procs))
+	for _, kp := range procs {
+		pids = append(pids, kp.pid)
+		byPID[kp.pid] = kp
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.procs = byPID
+	s.bootTime = bootTime
+	return pids, nil
+}
+
+// BootTime returns the boot time from the kern.boottime sysctl.
+func (s *kinfoSource) BootTime() (float64, error) {
+	buf, err := unix.SysctlRaw("kern.boottime")
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) < 16 {
+		return 0, fmt.Errorf("short kern.boottime of %d bytes", len(buf))
+	}
+	return timeval(buf), nil
+}
+
+// Stat returns a process as read by the last call of PIDs, with its command
+// line from kern.proc.args.
+func (s *kinfoSource) Stat(pid int) (ProcStat, error) {
+	s.mtx.Lock()
+	kp, ok := s.procs[pid]
+	bootTime := s.bootTime
+	s.mtx.Unlock()
+	if !ok {
+		return ProcStat{}, fmt.Errorf("process %d not found", pid)
+	}
+
+	return ProcStat{
+		PID:            kp.pid,
+		PPID:           kp.ppid,
+		PGID:           kp.pgid,
+		SID:            kp.sid,
+		Comm:           kp.comm,
+		Cmdline:        readProcArgs(kp.pid),
+		UID:            kp.uid,
+		TTY:            kp.tty,
+		CPUUser:        kp.user,
+		CPUSystem:      kp.system,
+		VirtualMemory:  kp.virt,
+		ResidentMemory: kp.rss,
+		NumThreads:     kp.threads,
+		MajorFaults:    kp.majorFaults,
+		StartTime:      kp.start - bootTime,
+	}, nil
+}
+
+// CheckProcfs always succeeds, as processes are read with sysctls and a
+// procfs is only needed by some matchers.
+func CheckProcfs(procfsPath string) error {
+	return nil
+}
+
+// countSharedVM always returns 0, as kcmp(2) is specific to Linux.
+func countSharedVM(pids []int) uint64 {
+	return 0
+}
+
+// readKinfoProcs returns all processes of the host from the
+// kern.proc.proc sysctl, which has one kinfo_proc per process rather than
+// per thread.
+func readKinfoProcs() ([]kinfoProc, error) {
+	buf, err := unix.SysctlRaw("kern.proc.proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := float64(os.Getpagesize())
+	le := binary.LittleEndian
+
+	var procs []kinfoProc
+	for len(buf) > 0 {
+		if len(buf) < kinfoProcSize {
+			return nil, fmt.Errorf("short kinfo_proc of %d bytes", len(buf))
+		}
+		if size := int(le.Uint32(buf)); size != kinfoProcSize {
+			return nil, fmt.Errorf("unexpected kinfo_proc size %d, want %d", size, kinfoProcSize)
+		}
+
+		kp := kinfoProc{
+			pid:         int(int32(le.Uint32(buf[kiPid:]))),
+			ppid:        int(int32(le.Uint32(buf[kiPpid:]))),
+			pgid:        int(int32(le.Uint32(buf[kiPgid:]))),
+			sid:         int(int32(le.Uint32(buf[kiSid:]))),
+			uid:         int(le.Uint32(buf[kiUid:])),
+			virt:        float64(le.Uint64(buf[kiSize:])),
+			rss:         float64(int64(le.Uint64(buf[kiRssize:]))) * pageSize,
+			start:       timeval(buf[kiStart:]),
+			user:        timeval(buf[kiRusage:]),
+			system:      timeval(buf[kiRusage+16:]),
+			threads:     uint64(le.Uint32(buf[kiNumthreads:])),
+			majorFaults: le.Uint64(buf[kiMajflt:]),
+		}
+		if tdev := le.Uint32(buf[kiTdev:]); tdev != noDev {
+			kp.tty = int(tdev)
+		}
+		comm := buf[kiComm : kiComm+kiCommLen]
+		if i := bytes.IndexByte(comm, 0); i >= 0 {
+			comm = comm[:i]
+		}
+		kp.comm = string(comm)
+
+		procs = append(procs, kp)
+		buf = buf[kinfoProcSize:]
+	}
+	return procs, nil
+}
+
+// readProcArgs returns the command line of a process from the
+// kern.proc.args sysctl, or nil if it can't be read, e.g. for kernel
+// processes or those that exited meanwhile.
+func readProcArgs(pid int) []string {
+	buf, err := unix.SysctlRaw("kern.proc.args", pid)
+	if err != nil || len(buf) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(buf), "\x00"), "\x00")
+}
+
+// timeval returns a struct timeval of amd64 in seconds.
+func timeval(b []byte) float64 {
+	le := binary.LittleEndian
+	return float64(int64(le.Uint64(b))) + float64(int64(le.Uint64(b[8:])))/1e6
+}
@@ -0,0 +1,220 @@
+package collector
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/procfs"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// procfsMetrics tells whether the metrics read from further files of
+	// a process under the procfs path, such as status or io, are
+	// available.
+	procfsMetrics = true
+
+	// procSuperMagic is the filesystem type of procfs reported by statfs.
+	procSuperMagic = 0x9fa0
+
+	// kcmpVM is the kcmp(2) type comparing the virtual memory of two
+	// processes.
+	kcmpVM = 1
+)
+
+// procfsSource reads processes from the procfs mounted at procfsPath.
+type procfsSource struct {
+	procfsPath string
+}
+
+// newProcSource returns the ProcSource of the platform, reading from the
+// procfs mounted at procfsPath.
+func newProcSource(procfsPath string) ProcSource {
+	return procfsSource{procfsPath}
+}
+
+// PIDs returns the IDs of the processes listed in the procfs.
+func (s procfsSource) PIDs() ([]int, error) {
+	fs, err := procfs.NewFS(s.procfsPath)
+	if err != nil {
+		return nil, err
+	}
+	procs, err := fs.AllProcs()
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, len(procs))
+	for i, p := range procs {
+		pids[i] = p.PID
+	}
+	return pids, nil
+}
+
+// BootTime returns the boot time from /proc/stat.
+func (s procfsSource) BootTime() (float64, error) {
+	fs, err := procfs.NewFS(s.procfsPath)
+	if err != nil {
+		return 0, err
+	}
+	fstat, err := fs.NewStat()
+	if err != nil {
+		return 0, err
+	}
+	return float64(fstat.BootTime), nil
+}
+
+// Stat reads /proc/<pid>/stat and cmdline, and the owner of the process.
+func (s procfsSource) Stat(pid int) (ProcStat, error) {
+	stat, blkioTicks, err := readProcStat(s.procfsPath, pid)
+	if err != nil {
+		return ProcStat{}, err
+	}
+	cmdline, err := ioutil.ReadFile(filepath.Join(s.procfsPath, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return ProcStat{}, err
+	}
+
+	return ProcStat{
+		PID: pid,
+		// the leader's comm, as only thread group leaders are listed
+		Comm:           stat.Comm,
+		Cmdline:        splitCmdline(cmdline),
+		UID:            s.owner(pid),
+		PPID:           stat.PPID,
+		PGID:           stat.PGRP,
+		SID:            stat.Session,
+		TTY:            stat.TTY,
+		CPUUser:        float64(stat.UTime) / userHZ,
+		CPUSystem:      float64(stat.STime) / userHZ,
+		VirtualMemory:  float64(stat.VirtualMemory()),
+		ResidentMemory: float64(stat.ResidentMemory()),
+		NumThreads:     uint64(stat.NumThreads),
+		MajorFaults:    uint64(stat.MajFlt),
+		StartTime:      float64(stat.Starttime) / userHZ,
+		BlkioDelay:     float64(blkioTicks) / userHZ,
+	}, nil
+}
+
+// owner returns the UID owning a process, or -1 if it couldn't be
+// determined, e.g. because the process exited.
+func (s procfsSource) owner(pid int) int {
+	fi, err := os.Stat(filepath.Join(s.procfsPath, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return -1
+	}
+	fstat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1
+	}
+	return int(fstat.Uid)
+}
+
+// splitCmdline splits the NUL separated content of /proc/<pid>/cmdline.
+// Kernel threads have an empty one.
+func splitCmdline(data []byte) []string {
+	if len(data) == 0 {
+		return []string{}
+	}
+	return strings.Split(string(data[:len(data)-1]), "\x00")
+}
+
+// CheckProcfs returns an error if procfsPath is not a mounted procfs, e.g.
+// when the exporter started before /proc was mounted, or a mount into its
+// container is missing.
+func CheckProcfs(procfsPath string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(procfsPath, &st); err != nil {
+		return err
+	}
+	if int64(st.Type) != procSuperMagic {
+		return fmt.Errorf("%s is not a procfs mount (filesystem type %#x)", procfsPath, st.Type)
+	}
+	return nil
+}
+
+// countSharedVM returns the number of pids sharing their virtual memory with
+// another one of pids. kcmp(2) orders processes by their memory, so that
+// those sharing it end up next to each other once sorted. It returns 0 if
+// any pair can't be compared, e.g. without ptrace access or after a process
+// exited.
+func countSharedVM(pids []int) uint64 {
+	if len(pids) < 2 {
+		return 0
+	}
+
+	var failed bool
+	cmp := func(a, b int) uintptr {
+		r, _, errno := syscall.Syscall6(unix.SYS_KCMP, uintptr(a), uintptr(b), kcmpVM, 0, 0, 0)
+		// 3 means that the kernel doesn't order the processes
+		if errno != 0 || r == 3 {
+			failed = true
+		}
+		return r
+	}
+	sort.Slice(pids, func(i, j int) bool {
+		return cmp(pids[i], pids[j]) == 1
+	})
+
+	var shared uint64
+	run := 1
+	for i := 1; i <= len(pids); i++ {
+		if i < len(pids) && cmp(pids[i-1], pids[i]) == 0 {
+			run += 1
+			continue
+		}
+		if run > 1 {
+			shared += uint64(run)
+		}
+		run = 1
+	}
+	if failed {
+		log.Debugf("Can't compare the virtual memory of processes %v", pids)
+		return 0
+	}
+	return shared
+}
+
+// readProcStat reads /proc/<pid>/stat like procfs.Proc.NewStat, and also
+// returns the aggregated block IO delay in clock ticks from the same read,
+// field 42. The delay is 0 when the field is missing, e.g. on old kernels.
+func readProcStat(procfsPath string, pid int) (procfs.ProcStat, uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procfsPath, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procfs.ProcStat{}, 0, err
+	}
+
+	// the comm is parenthesized and may contain spaces and parentheses
+	// itself
+	l := bytes.IndexByte(data, '(')
+	r := bytes.LastIndexByte(data, ')')
+	if l < 0 || r < l || r+2 > len(data) {
+		return procfs.ProcStat{}, 0, fmt.Errorf("unexpected stat content %q", data)
+	}
+	stat := procfs.ProcStat{PID: pid, Comm: string(data[l+1 : r])}
+	var ignore int
+	_, err = fmt.Sscan(string(data[r+2:]),
+		&stat.State, &stat.PPID, &stat.PGRP, &stat.Session, &stat.TTY,
+		&stat.TPGID, &stat.Flags, &stat.MinFlt, &stat.CMinFlt, &stat.MajFlt,
+		&stat.CMajFlt, &stat.UTime, &stat.STime, &stat.CUTime, &stat.CSTime,
+		&stat.Priority, &stat.Nice, &stat.NumThreads, &ignore,
+		&stat.Starttime, &stat.VSize, &stat.RSS,
+	)
+	if err != nil {
+		return procfs.ProcStat{}, 0, err
+	}
+
+	// the fields following the comm start at field 3, the state
+	var blkioTicks uint64
+	if fields := strings.Fields(string(data[r+1:])); len(fields) > 42-3 {
+		blkioTicks, _ = strconv.ParseUint(fields[42-3], 10, 64)
+	}
+	return stat, blkioTicks, nil
+}
@@ -0,0 +1,79 @@
+//go:build !linux && !(freebsd && amd64)
+// +build !linux
+// +build !freebsd !amd64
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errUnsupportedPlatform = errors.New("proc collector is not supported on " + runtime.GOOS)
+
+// ProcCollector is unsupported outside of Linux and FreeBSD.
+type ProcCollector struct {
+	unsupported *prometheus.Desc
+}
+
+// NewProcCollector returns a collector that reports an error on every
+// collection, since /proc is only available on Linux. It allows the matcher
+// and config code to be built and tested on other platforms.
+func NewProcCollector(procfsPath string, matchnamer MatchNamer, opts Options) *ProcCollector {
+	return &ProcCollector{
+		unsupported: prometheus.NewDesc(
+			"proc_unsupported_platform",
+			"Proc collector is not supported on this platform.",
+			nil,
+			opts.ConstLabels,
+		),
+	}
+}
+
+// CheckProcfs always fails with an unsupported platform error.
+func CheckProcfs(procfsPath string) error {
+	return errUnsupportedPlatform
+}
+
+// fileID never identifies files.
+func fileID(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
+
+// MatchProcs always fails with an unsupported platform error.
+func MatchProcs(procfsPath string, matchnamer MatchNamer) ([]ProcMatch, error) {
+	return nil, errUnsupportedPlatform
+}
+
+// Snapshot always fails with an unsupported platform error.
+func (c *ProcCollector) Snapshot() ([]ProcGroupResult, error) {
+	return nil, errUnsupportedPlatform
+}
+
+// ForGroup returns c, which fails regardless of the group.
+func (c *ProcCollector) ForGroup(group string) prometheus.Collector {
+	return c
+}
+
+// ForContext returns c, which fails regardless of the group.
+func (c *ProcCollector) ForContext(ctx context.Context, group string) prometheus.Collector {
+	return c
+}
+
+// SetMatchNamer does nothing.
+func (c *ProcCollector) SetMatchNamer(matchnamer MatchNamer) {
+}
+
+// Describe returns all descriptions of the collector.
+func (c *ProcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.unsupported
+}
+
+// Collect returns an invalid metric carrying the unsupported platform error.
+func (c *ProcCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.NewInvalidMetric(c.unsupported, errUnsupportedPlatform)
+}
@@ -0,0 +1,526 @@
+//go:build linux
+// +build linux
+
+package collector
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeSource serves a fixed set of processes, for tests independent of the
+// processes of the host.
+type fakeSource struct {
+	bootTime float64
+	procs    []ProcStat
+}
+
+func (s fakeSource) PIDs() ([]int, error) {
+	pids := make([]int, len(s.procs))
+	for i, p := range s.procs {
+		pids[i] = p.PID
+	}
+	return pids, nil
+}
+
+func (s fakeSource) BootTime() (float64, error) {
+	return s.bootTime, nil
+}
+
+func (s fakeSource) Stat(pid int) (ProcStat, error) {
+	for _, p := range s.procs {
+		if p.PID == pid {
+			return p, nil
+		}
+	}
+	return ProcStat{}, fmt.Errorf("no process %d", pid)
+}
+
+// newTestCollector returns a collector of procs matched by the YAML config,
+// reading other files of the processes from testdata/proc.
+func newTestCollector(t *testing.T, config string, opts Options, procs ...ProcStat) *ProcCollector {
+	t.Helper()
+	c := NewProcCollector("testdata/proc", mustGetConfig(t, config).MatchNamers, opts)
+	c.source = fakeSource{bootTime: 1500000000, procs: procs}
+	return c
+}
+
+// snapshotGroups returns the groups read by c by name.
+func snapshotGroups(t *testing.T, c *ProcCollector) map[string]ProcGroupResult {
+	t.Helper()
+	groups, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]ProcGroupResult, len(groups))
+	for _, g := range groups {
+		byName[g.Name] = g
+	}
+	return byName
+}
+
+// collectMetrics collects c and returns the metrics of desc.
+func collectMetrics(t *testing.T, c *ProcCollector, desc *prometheus.Desc) []*dto.Metric {
+	t.Helper()
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var metrics []*dto.Metric
+	for m := range ch {
+		if m.Desc() != desc {
+			continue
+		}
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		metrics = append(metrics, &pb)
+	}
+	return metrics
+}
+
+func TestNumChildren(t *testing.T) {
+	proc := func(pid, ppid int, comm string) ProcStat {
+		return ProcStat{PID: pid, PPID: ppid, Comm: comm, NumThreads: 1}
+	}
+	c := newTestCollector(t, `
+process_names:
+  - comm: [systemd, supervisord, worker, cron]
+`, Options{NoFds: true},
+		proc(1, 0, "systemd"),
+		proc(10, 1, "supervisord"),
+		proc(11, 10, "worker"),
+		proc(12, 10, "worker"),
+		proc(13, 10, "worker"),
+		proc(20, 1, "cron"),
+		// unmatched children count too
+		proc(21, 20, "sh"),
+		proc(22, 21, "sleep"),
+	)
+
+	groups := snapshotGroups(t, c)
+	for name, want := range map[string]uint64{
+		"systemd":     2,
+		"supervisord": 3,
+		"worker":      0,
+		"cron":        1,
+	} {
+		if got := groups[name].NumChildren; got != want {
+			t.Errorf("group %s: NumChildren = %d, want %d", name, got, want)
+		}
+	}
+	if g := groups["worker"]; g.NumProcs != 3 {
+		t.Errorf("group worker: NumProcs = %d, want 3", g.NumProcs)
+	}
+}
+
+func TestReadMaps(t *testing.T) {
+	info, err := readMaps("testdata/proc", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mapsInfo{
+		// the /SYSV segment mapped twice, and two under /dev/shm
+		shmSegments: 3,
+		// app, libc and the shared memory files
+		files: 5,
+		bytes: 0x80000 + 0x200000 + 0x2000 + 0x100000,
+	}
+	if info != want {
+		t.Errorf("readMaps() = %+v, want %+v", info, want)
+	}
+
+	c := newTestCollector(t, `
+process_names:
+  - comm: [app]
+`, Options{NoFds: true, SharedMemory: true, MappedFiles: true},
+		ProcStat{PID: 100, PPID: 1, Comm: "app"},
+	)
+	g := snapshotGroups(t, c)["app"]
+	if g.ShmSegments != want.shmSegments || g.MappedFiles != want.files || g.MappedBytes != want.bytes {
+		t.Errorf("group app: ShmSegments, MappedFiles, MappedBytes = %d, %d, %d, want %d, %d, %d",
+			g.ShmSegments, g.MappedFiles, g.MappedBytes, want.shmSegments, want.files, want.bytes)
+	}
+}
+
+func TestCountCPUList(t *testing.T) {
+	for list, want := range map[string]int{
+		"":            0,
+		"0":           1,
+		"0-3":         4,
+		"0-3,8,12-15": 9,
+		"0-63":        64,
+		"1,3,5":       3,
+		"3-1":         0,
+		"0-3,x":       0,
+		"0-":          0,
+	} {
+		if got := countCPUList(list); got != want {
+			t.Errorf("countCPUList(%q) = %d, want %d", list, got, want)
+		}
+	}
+
+	// the most constrained process of the group counts
+	c := newTestCollector(t, `
+process_names:
+  - name: all
+    comm: [app, worker]
+`, Options{NoFds: true, AllowedCPUs: true},
+		ProcStat{PID: 100, PPID: 1, Comm: "app"},
+		ProcStat{PID: 101, PPID: 1, Comm: "worker"},
+	)
+	if got := snapshotGroups(t, c)["all"].AllowedCPUs; got != 1 {
+		t.Errorf("AllowedCPUs = %v, want 1", got)
+	}
+	c = newTestCollector(t, `
+process_names:
+  - comm: [app]
+`, Options{NoFds: true, AllowedCPUs: true},
+		ProcStat{PID: 100, PPID: 1, Comm: "app"},
+	)
+	if got := snapshotGroups(t, c)["app"].AllowedCPUs; got != 9 {
+		t.Errorf("AllowedCPUs = %v, want 9", got)
+	}
+}
+
+func TestAggregateUnreadable(t *testing.T) {
+	// 103 has neither status nor limits: it is left out of the aggregates
+	// of 100 and 101, even as the first process of the group
+	procs := []ProcStat{
+		{PID: 103, PPID: 1, Comm: "worker"},
+		{PID: 100, PPID: 1, Comm: "app"},
+		{PID: 101, PPID: 1, Comm: "worker"},
+	}
+	for _, tc := range []struct {
+		agg                  Aggregation
+		allowedCPUs, fdLimit float64
+	}{
+		{AggregateMin, 1, 1024},
+		{AggregateMax, 9, 4096},
+		{AggregateAvg, 5, 2560},
+		{AggregateSum, 10, 5120},
+	} {
+		opts := Options{AllowedCPUs: true, FdLimit: true, Aggregations: map[string]Aggregation{
+			"allowed_cpus": tc.agg,
+			"fd_limit":     tc.agg,
+		}}
+		g := snapshotGroups(t, newTestCollector(t, `
+process_names:
+  - name: all
+    comm: [app, worker]
+`, opts, procs...))["all"]
+		if g.NumProcs != 3 {
+			t.Fatalf("NumProcs = %d, want 3", g.NumProcs)
+		}
+		if g.AllowedCPUs != tc.allowedCPUs {
+			t.Errorf("%s AllowedCPUs = %v, want %v", tc.agg, g.AllowedCPUs, tc.allowedCPUs)
+		}
+		if g.FdLimit != tc.fdLimit {
+			t.Errorf("%s FdLimit = %v, want %v", tc.agg, g.FdLimit, tc.fdLimit)
+		}
+	}
+}
+
+func TestNumFdsUnreadable(t *testing.T) {
+	// 104 has no fd directory, as if owned by another user: it is left out
+	// of the aggregate instead of counting as 0 fds
+	config := `
+process_names:
+  - name: all
+    comm: [app, java]
+`
+	java := ProcStat{PID: 104, PPID: 1, Comm: "java"}
+	opts := Options{Aggregations: map[string]Aggregation{"num_fds": AggregateMin}}
+	c := newTestCollector(t, config, opts, java, ProcStat{PID: 100, PPID: 1, Comm: "app"})
+	if got := snapshotGroups(t, c)["all"].NumFds; got != 5 {
+		t.Errorf("NumFds = %v, want 5", got)
+	}
+
+	// without any fds read, the group has no proc_num_fds
+	c = newTestCollector(t, config, opts, java)
+	if got := collectMetrics(t, c, c.numFds); len(got) != 0 {
+		t.Errorf("proc_num_fds = %v, want none", got)
+	}
+}
+
+func TestReadThreadStates(t *testing.T) {
+	states, err := readThreadStates("testdata/proc", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint64{
+		"sleeping":   1,
+		"disk_sleep": 2,
+		"running":    1,
+		// unknown states are kept by their letter
+		"Q": 1,
+	}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("readThreadStates() = %v, want %v", states, want)
+	}
+	if _, err := readThreadStates("testdata/proc", 102); !os.IsNotExist(err) {
+		t.Errorf("readThreadStates() of a missing process = %v, want not exist error", err)
+	}
+
+	c := newTestCollector(t, `
+process_names:
+  - name: all
+    comm: [app, worker]
+`, Options{NoFds: true, ThreadStates: true},
+		ProcStat{PID: 100, PPID: 1, Comm: "app", NumThreads: 5},
+		// no task directory
+		ProcStat{PID: 102, PPID: 1, Comm: "worker", NumThreads: 1},
+	)
+	if got := snapshotGroups(t, c)["all"].ThreadStates; !reflect.DeepEqual(got, want) {
+		t.Errorf("ThreadStates = %v, want %v", got, want)
+	}
+}
+
+func TestStatLeaderComm(t *testing.T) {
+	// the threads of 104 renamed themselves, which doesn't show in the
+	// stat of the process
+	source := newProcSource("testdata/proc")
+	stat, err := source.Stat(104)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Comm != "java" {
+		t.Errorf("Comm = %q, want %q", stat.Comm, "java")
+	}
+	if want := []string{"java", "-jar", "app.jar"}; !reflect.DeepEqual(stat.Cmdline, want) {
+		t.Errorf("Cmdline = %q, want %q", stat.Cmdline, want)
+	}
+	if stat.NumThreads != 3 {
+		t.Errorf("NumThreads = %d, want 3", stat.NumThreads)
+	}
+
+	c := newTestCollector(t, `
+process_names:
+  - comm: [java, C2 CompilerThre, "GC Thread#0"]
+`, Options{NoFds: true}, stat)
+	groups := snapshotGroups(t, c)
+	if g := groups["java"]; g.NumProcs != 1 || g.NumThreads != 3 {
+		t.Errorf("group java: NumProcs, NumThreads = %d, %d, want 1, 3", g.NumProcs, g.NumThreads)
+	}
+	if len(groups) != 1 {
+		t.Errorf("groups = %v, want only java", groups)
+	}
+}
+
+func TestFdTypes(t *testing.T) {
+	for _, tc := range []struct {
+		target, want string
+	}{
+		{"socket:[1111]", "socket"},
+		{"pipe:[4444]", "pipe"},
+		{"anon_inode:[eventfd]", "anon"},
+		{"anon_inode:inotify", "anon"},
+		{"/dev/null", "file"},
+		{"/var/log/app.log (deleted)", "file"},
+		{"net:[4026531840]", "other"},
+		{"", "other"},
+	} {
+		if got := fdType(tc.target); got != tc.want {
+			t.Errorf("fdType(%q) = %q, want %q", tc.target, got, tc.want)
+		}
+	}
+
+	c := newTestCollector(t, `
+process_names:
+  - name: all
+    comm: [app, gpu]
+`, Options{FdTypes: true},
+		ProcStat{PID: 100, PPID: 1, Comm: "app"},
+		ProcStat{PID: 103, PPID: 1, Comm: "gpu"},
+	)
+	want := map[string]uint64{
+		"socket": 3,
+		"pipe":   1,
+		"anon":   1,
+		"file":   6,
+	}
+	if got := snapshotGroups(t, c)["all"].FdTypes; !reflect.DeepEqual(got, want) {
+		t.Errorf("FdTypes = %v, want %v", got, want)
+	}
+}
+
+func TestMajorFaultsCounter(t *testing.T) {
+	c := newTestCollector(t, `
+process_names:
+  - comm: [app]
+`, Options{NoFds: true},
+		ProcStat{PID: 100, PPID: 1, Comm: "app", MajorFaults: 12},
+		ProcStat{PID: 101, PPID: 1, Comm: "app", MajorFaults: 30},
+	)
+	metrics := collectMetrics(t, c, c.majorFaults)
+	if len(metrics) != 1 {
+		t.Fatalf("got %d major faults metrics, want 1", len(metrics))
+	}
+	if metrics[0].Counter == nil || metrics[0].Gauge != nil {
+		t.Fatalf("major faults metric = %v, want a counter", metrics[0])
+	}
+	if got := metrics[0].Counter.GetValue(); got != 42 {
+		t.Errorf("major faults = %v, want 42", got)
+	}
+}
+
+func TestPinnedClock(t *testing.T) {
+	procs := func(cpu float64) []ProcStat {
+		return []ProcStat{
+			{PID: 100, PPID: 1, Comm: "app", StartTime: 100, CPUUser: cpu},
+			{PID: 101, PPID: 1, Comm: "app", StartTime: 400, CPUUser: cpu},
+		}
+	}
+	c := newTestCollector(t, `
+process_names:
+  - comm: [app]
+`, Options{NoFds: true, CPUUtilization: true}, procs(10)...)
+	now := time.Unix(1500001000, 0)
+	c.now = func() time.Time { return now }
+
+	gauge := func(desc *prometheus.Desc) []float64 {
+		var values []float64
+		for _, m := range collectMetrics(t, c, desc) {
+			values = append(values, m.GetGauge().GetValue())
+		}
+		return values
+	}
+	if got, want := gauge(c.oldestRunning), []float64{900}; !reflect.DeepEqual(got, want) {
+		t.Errorf("oldest running = %v, want %v", got, want)
+	}
+	if got, want := gauge(c.newestRunning), []float64{600}; !reflect.DeepEqual(got, want) {
+		t.Errorf("newest running = %v, want %v", got, want)
+	}
+
+	// both processes used 2.5s of CPU in 10s
+	c.source = fakeSource{bootTime: 1500000000, procs: procs(12.5)}
+	now = now.Add(10 * time.Second)
+	if got, want := gauge(c.cpuUtilization), []float64{0.5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CPU utilization = %v, want %v", got, want)
+	}
+	// the clock didn't move
+	if got := gauge(c.cpuUtilization); got != nil {
+		t.Errorf("CPU utilization without elapsed time = %v, want none", got)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	for _, tc := range []struct {
+		pid  int
+		file string
+	}{
+		// v1 preferred over v2 on hybrid hosts
+		{100, "testdata/cgroup/memory/app/memory.limit_in_bytes"},
+		{101, "testdata/cgroup/system.slice/worker.service/memory.max"},
+		{103, "testdata/cgroup/user.slice/memory.max"},
+		{104, "testdata/cgroup/memory.max"},
+	} {
+		file, err := memoryLimitFile("testdata/proc", "testdata/cgroup", tc.pid)
+		if err != nil {
+			t.Errorf("pid %d: %v", tc.pid, err)
+		} else if file != tc.file {
+			t.Errorf("pid %d: memoryLimitFile() = %q, want %q", tc.pid, file, tc.file)
+		}
+	}
+	if _, err := memoryLimitFile("testdata/proc", "testdata/cgroup", 102); !os.IsNotExist(err) {
+		t.Errorf("memoryLimitFile() of a missing process = %v, want not exist error", err)
+	}
+
+	for file, want := range map[string]float64{
+		"testdata/cgroup/memory/app/memory.limit_in_bytes":       536870912,
+		"testdata/cgroup/memory/unlimited/memory.limit_in_bytes": math.Inf(1),
+		"testdata/cgroup/system.slice/worker.service/memory.max": 268435456,
+		"testdata/cgroup/user.slice/memory.max":                  math.Inf(1),
+	} {
+		if got, err := readMemoryLimit(file); err != nil || got != want {
+			t.Errorf("readMemoryLimit(%q) = %v, %v, want %v", file, got, err, want)
+		}
+	}
+	// the root cgroup has no limit
+	if _, err := readMemoryLimit("testdata/cgroup/memory.max"); !os.IsNotExist(err) {
+		t.Errorf("readMemoryLimit() of the root cgroup = %v, want not exist error", err)
+	}
+
+	c := newTestCollector(t, `
+process_names:
+  - name: all
+    comm: [app, worker, java]
+`, Options{NoFds: true, CgroupMemoryLimit: true, CgroupfsPath: "testdata/cgroup"},
+		ProcStat{PID: 100, PPID: 1, Comm: "app"},
+		ProcStat{PID: 101, PPID: 1, Comm: "worker"},
+		// in the root cgroup
+		ProcStat{PID: 104, PPID: 1, Comm: "java"},
+	)
+	if got, want := snapshotGroups(t, c)["all"].CgroupMemoryLimit, float64(536870912+268435456); got != want {
+		t.Errorf("CgroupMemoryLimit = %v, want %v", got, want)
+	}
+}
+
+func TestThreadsNativeHistogram(t *testing.T) {
+	for _, tc := range []struct {
+		buckets []float64
+		// classic holds the cumulative counts of buckets
+		classic []uint64
+	}{
+		{nil, nil},
+		// sorted and deduplicated
+		{[]float64{4, 1, 4}, []uint64{1, 3}},
+	} {
+		c := newTestCollector(t, `
+process_names:
+  - comm: [app]
+`, Options{NoFds: true, NativeHistograms: true, ThreadsBuckets: tc.buckets},
+			ProcStat{PID: 100, PPID: 1, Comm: "app", NumThreads: 1},
+			ProcStat{PID: 101, PPID: 1, Comm: "app", NumThreads: 4},
+			ProcStat{PID: 102, PPID: 1, Comm: "app", NumThreads: 4},
+		)
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(c)
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h *dto.Histogram
+		for _, mf := range mfs {
+			if mf.GetName() == "proc_threads_per_process" && len(mf.Metric) == 1 {
+				h = mf.Metric[0].GetHistogram()
+			}
+		}
+		if h == nil {
+			t.Errorf("buckets %v: no threads per process histogram", tc.buckets)
+			continue
+		}
+		if h.GetSampleCount() != 3 || h.GetSampleSum() != 9 {
+			t.Errorf("buckets %v: count, sum = %d, %v, want 3, 9", tc.buckets, h.GetSampleCount(), h.GetSampleSum())
+		}
+		// the schema of the bucket factor 1.1
+		if h.Schema == nil || h.GetSchema() != 3 {
+			t.Errorf("buckets %v: schema = %v, want 3", tc.buckets, h.Schema)
+		}
+		// bucket counts are delta encoded
+		var native, count int64
+		for _, d := range h.PositiveDelta {
+			count += d
+			native += count
+		}
+		if len(h.PositiveSpan) != 2 || native != 1+2 {
+			t.Errorf("buckets %v: native spans, deltas = %v, %v, want the buckets of 1 and 4", tc.buckets, h.PositiveSpan, h.PositiveDelta)
+		}
+		var classic []uint64
+		for _, b := range h.Bucket {
+			classic = append(classic, b.GetCumulativeCount())
+		}
+		if !reflect.DeepEqual(classic, tc.classic) {
+			t.Errorf("buckets %v: classic buckets = %v, want %v", tc.buckets, classic, tc.classic)
+		}
+	}
+}
@@ -2,20 +2,254 @@ package collector
 
 import (
 	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
+	"math"
+	"os"
+	"os/user"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/procfs"
 	"gopkg.in/yaml.v2"
 )
 
+// Aggregation selects how the values of the processes of a group are
+// combined into the value of the group.
+type Aggregation string
+
+// Supported aggregations.
+const (
+	AggregateSum Aggregation = "sum"
+	AggregateMax Aggregation = "max"
+	AggregateMin Aggregation = "min"
+	AggregateAvg Aggregation = "avg"
+)
+
+// DefaultAggregations maps the metric families whose aggregation can be
+// changed with Options.Aggregations, named without the proc_ prefix, to the
+// aggregation used by default. proc_memory_bytes also sets the aggregation of
+// proc_memory_percent. Counters are always summed.
+var DefaultAggregations = map[string]Aggregation{
+	"memory_bytes":  AggregateSum,
+	"num_fds":       AggregateSum,
+	"fd_limit":      AggregateMin,
+	"oom_score":     AggregateMax,
+	"oom_score_adj": AggregateMin,
+	"allowed_cpus":  AggregateMin,
+}
+
+// aggregate combines v, the value of the n-th process of a group, with cur,
+// the aggregate of the processes before it.
+func (a Aggregation) aggregate(cur, v float64, n uint64) float64 {
+	if n <= 1 {
+		return v
+	}
+	switch a {
+	case AggregateMax:
+		return math.Max(cur, v)
+	case AggregateMin:
+		return math.Min(cur, v)
+	case AggregateAvg:
+		return cur + (v-cur)/float64(n)
+	}
+	return cur + v
+}
+
+// LogMismatches enables the debug messages of command line matchers about
+// regexes not matching a process, for debugging configs. They are off by
+// default, as every process tested would format one.
+var LogMismatches bool
+
+// maxBuildIDs bounds the build IDs cached by a build_id matcher.
+const maxBuildIDs = 1024
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// capabilityNames maps the bits of a capability set, as in CapEff of
+// /proc/<pid>/status, to names as in capabilities(7) without the CAP_ prefix.
+var capabilityNames = []string{
+	"chown", "dac_override", "dac_read_search", "fowner", "fsetid", "kill",
+	"setgid", "setuid", "setpcap", "linux_immutable", "net_bind_service",
+	"net_broadcast", "net_admin", "net_raw", "ipc_lock", "ipc_owner",
+	"sys_module", "sys_rawio", "sys_chroot", "sys_ptrace", "sys_pacct",
+	"sys_admin", "sys_boot", "sys_nice", "sys_resource", "sys_time",
+	"sys_tty_config", "mknod", "lease", "audit_write", "audit_control",
+	"setfcap", "mac_override", "mac_admin", "syslog", "wake_alarm",
+	"block_suspend", "audit_read", "perfmon", "bpf", "checkpoint_restore",
+}
+
+// Values of the cmdline_mode key, selecting how cmdline regexes see the
+// arguments of a process.
+const (
+	// cmdlineModeSpace joins the arguments with a space. This is the default.
+	cmdlineModeSpace = "space"
+	// cmdlineModeNul joins the arguments with NUL, as in /proc/<pid>/cmdline,
+	// so that argument boundaries are preserved.
+	cmdlineModeNul = "nul"
+	// cmdlineModeArgs applies each regex to every argument separately and
+	// succeeds if any of them matches.
+	cmdlineModeArgs = "args"
+)
+
 type (
 	NameAndCmdline struct {
-		Name    string
-		Cmdline []string
+		// Name is the comm of the thread group leader, from
+		// /proc/<pid>/stat. Threads renaming themselves, as thread pools
+		// of Java or Go programs do, don't change it, unless the main
+		// thread does.
+		Name     string
+		Cmdline  []string
+		UID      int
+		Username string
+		// TTY is the tty_nr field of /proc/<pid>/stat, 0 if the process has
+		// no controlling terminal.
+		TTY int
+		PID int
+		// SID and PGID are the session and process group IDs.
+		SID  int
+		PGID int
+		// StartTime is the start time of the process in seconds since the
+		// epoch, 0 if the boot time it is relative to couldn't be read.
+		StartTime float64
+
+		// procfsPath is where matchers read further files of the process
+		// from, on demand. Defaults to /proc.
+		procfsPath string
+	}
+
+	// ProcMatch is the outcome of matching a single process.
+	ProcMatch struct {
+		NameAndCmdline
+		Matched   bool
+		GroupName string
+	}
+
+	// Explanation tells which config entry matched a process, see
+	// Config.Explain.
+	Explanation struct {
+		Matched bool
+		// Index is the position of the matching entry in
+		// Config.MatchNamers, which is sorted by priority, or -1. An entry
+		// ignoring the process for its sample rate is reported with
+		// Matched false.
+		Index int
+		Name  string
+		// Matches holds the groups captured by the matchers of the entry,
+		// as available to its name template as .Matches.
+		Matches map[string]string
+	}
+
+	// ProcGroupResult holds the values collected for a group of processes.
+	// Memory sizes are in bytes, times in seconds. Start times are 0 if the
+	// boot time of the host couldn't be read.
+	ProcGroupResult struct {
+		Name            string
+		Account         string
+		CPUSystem       float64
+		CPUUser         float64
+		MemVirt         float64
+		MemRss          float64
+		MemStack        float64
+		MemData         float64
+		MemText         float64
+		MemLib          float64
+		NumProcs        uint64
+		NumThreads      uint64
+		MaxThreads      uint64
+		OldestStartTime float64
+		NewestStartTime float64
+		BlkioDelay      float64
+		MajorFaults     uint64
+		SyscR           uint64
+		SyscW           uint64
+		// ThreadsBuckets counts the processes with at most as many threads
+		// as the bound, for each bound of Options.ThreadsBuckets.
+		ThreadsBuckets map[float64]uint64
+		// threadCounts are the thread counts of the processes, kept for
+		// the native histogram with Options.NativeHistograms.
+		threadCounts []float64
+		// NumFds is aggregated over the fdsProcs processes whose fds could
+		// be read.
+		NumFds   float64
+		fdsProcs uint64
+		FdLimit  float64
+		// fdLimits counts the processes whose FdLimit could be read, the
+		// ones aggregated into it.
+		fdLimits        uint64
+		CmdlineBytes    uint64
+		CmdlineMaxBytes uint64
+		// RssValues are the resident memory sizes of the processes, kept
+		// only with Options.MemoryQuantiles.
+		RssValues   []float64
+		NumChildren uint64
+		ShmSegments uint64
+		// MainCPUSystem and MainCPUUser are the CPU times of the main
+		// threads, kept only with Options.CPUByThreadRole.
+		MainCPUSystem float64
+		MainCPUUser   float64
+		// MappedFiles and MappedBytes are the number of files mapped by
+		// each process and the size of those mappings, kept only with
+		// Options.MappedFiles.
+		MappedFiles uint64
+		MappedBytes uint64
+		OomScore    float64
+		OomScoreAdj float64
+		// AllowedCPUs is the number of CPUs in the affinity mask, aggregated
+		// over the allowedCPUsProcs processes whose mask could be read.
+		AllowedCPUs      float64
+		allowedCPUsProcs uint64
+		// WchanProcs counts the sleeping processes by the kernel function
+		// they wait in, kept only with Options.Wchan.
+		WchanProcs map[string]uint64
+		// FdTypes counts the open fds by the type returned by fdType, kept
+		// only with Options.FdTypes.
+		FdTypes map[string]uint64
+		// ThreadStates counts the threads by scheduler state, kept only with
+		// Options.ThreadStates.
+		ThreadStates map[string]uint64
+		// CwdFsUsed is the used space of the distinct filesystems holding
+		// the working directories, kept only with Options.CwdFilesystem.
+		CwdFsUsed float64
+		cwdFs     map[string]struct{}
+		// CgroupMemoryLimit is the summed memory limit of the distinct
+		// memory cgroups of the processes, +Inf if any is unlimited, kept
+		// only with Options.CgroupMemoryLimit. memCgroups is nil if no
+		// limit could be read.
+		CgroupMemoryLimit float64
+		memCgroups        map[string]struct{}
+		// Cmdline is the command line of the oldest process, ties going to
+		// the lowest PID, kept only with Options.CmdlineInfo.
+		Cmdline      string
+		cmdlinePID   int
+		cmdlineStart float64
+		// ExeProcs counts the processes by argv[0], kept only with
+		// Options.MembersByExe.
+		ExeProcs map[string]uint64
+		// UniqueExes counts the distinct executable basenames.
+		UniqueExes uint64
+		exes       map[string]struct{}
+		// CloneSharedVM counts the processes sharing their virtual memory
+		// with another one of the group, kept only with
+		// Options.CloneSharedVM.
+		CloneSharedVM uint64
+		pids          []int
 	}
 
 	MatchNamer interface {
@@ -24,6 +258,15 @@ type (
 		MatchAndName(NameAndCmdline) (bool, string)
 	}
 
+	// AccountMatchNamer is a MatchNamer that can also set the account of
+	// the group, instead of the owner of the process.
+	AccountMatchNamer interface {
+		MatchNamer
+		// MatchAndNameAccount is like MatchAndName, and also returns the
+		// account, or an empty string to keep the owner.
+		MatchAndNameAccount(NameAndCmdline) (bool, string, string)
+	}
+
 	Matcher interface {
 		// Match returns empty string for no match, or the group name on success.
 		Match(NameAndCmdline) (bool, map[string]string)
@@ -31,20 +274,257 @@ type (
 
 	FirstMatcher []MatchNamer
 
+	// MostSpecificMatcher evaluates all entries and picks the matching one
+	// with the most matchers. Ties go to the first in config order.
+	MostSpecificMatcher []MatchNamer
+
+	// NameSanitizer replaces each of Chars with an underscore in the names
+	// returned by MatchNamer.
+	NameSanitizer struct {
+		MatchNamer
+		Chars string
+	}
+
+	// NameTruncator shortens the names returned by MatchNamer to at most
+	// MaxLength characters. Truncated names end in a hash of the full name,
+	// so that distinct long names stay distinct.
+	NameTruncator struct {
+		MatchNamer
+		MaxLength int
+	}
+
 	Config struct {
-		MatchNamers FirstMatcher
+		MatchNamers FirstMatcher `json:"process_names"`
+		// ExeTables are the paths of the exe tables the entries refer to,
+		// whose changes take effect on reload like those of the config.
+		ExeTables []string `json:"-"`
+	}
+
+	// Options enables optional collector features.
+	Options struct {
+		// MemoryPercent adds proc_memory_percent, the resident memory of a
+		// group as a percentage of MemTotal from /proc/meminfo.
+		MemoryPercent bool
+		// ThreadsBuckets are the upper bounds of the proc_threads_per_process
+		// histogram buckets. The histogram is disabled when empty, unless
+		// NativeHistograms is set.
+		ThreadsBuckets []float64
+		// NativeHistograms exposes proc_threads_per_process as a native
+		// histogram of exponential buckets, along with the classic buckets
+		// of ThreadsBuckets if any. Only the protobuf exposition format
+		// carries the native buckets, the text formats fall back to the
+		// classic ones.
+		NativeHistograms bool
+		// CPUUtilization adds proc_cpu_utilization, computed from the CPU
+		// totals of the previous scrape. Scrapes cut short by the timeout
+		// neither emit it nor replace the totals.
+		CPUUtilization bool
+		// MemorySegments adds the stack, data, text and lib memtypes of
+		// proc_memory_bytes, from VmStk, VmData, VmExe and VmLib of
+		// /proc/<pid>/status.
+		MemorySegments bool
+		// AllowedCPUs adds proc_allowed_cpus, the number of CPUs in
+		// Cpus_allowed_list of /proc/<pid>/status.
+		AllowedCPUs bool
+		// OomScore adds proc_oom_score and proc_oom_score_adj, from
+		// /proc/<pid>/oom_score and oom_score_adj.
+		OomScore bool
+		// IOSyscalls adds proc_io_syscalls_total, the read and write
+		// syscalls from /proc/<pid>/io.
+		IOSyscalls bool
+		// MemoryQuantiles are the quantiles of the per-process resident
+		// memory summary proc_memory_bytes_quantile. The summary is
+		// disabled when empty.
+		MemoryQuantiles []float64
+		// CountAmbiguous evaluates all config entries for every matched
+		// process, to count those matching more than one in
+		// proc_ambiguous_procs.
+		CountAmbiguous bool
+		// SharedMemory adds proc_shm_segments, parsed from
+		// /proc/<pid>/maps.
+		SharedMemory bool
+		// MappedFiles adds proc_mapped_files and proc_mapped_bytes, the
+		// files mapped by the processes of a group and the size of their
+		// mappings, parsed from /proc/<pid>/maps.
+		MappedFiles bool
+		// Wchan adds proc_wchan_processes, the number of processes
+		// sleeping in each kernel function, from /proc/<pid>/wchan.
+		Wchan bool
+		// FdTypes adds proc_fds_by_type, the open fds by type, classified
+		// by their link targets in /proc/<pid>/fd. It is dropped along with
+		// the other fd metrics by NoFds.
+		FdTypes bool
+		// CwdFilesystem adds proc_cwd_fs_used_bytes, the used space of the
+		// filesystems holding the working directories of a group.
+		CwdFilesystem bool
+		// CgroupMemoryLimit adds proc_cgroup_memory_limit_bytes, the memory
+		// limits of the cgroups of a group, read from memory.max on cgroup
+		// v2 and memory.limit_in_bytes on v1, under CgroupfsPath, or
+		// /sys/fs/cgroup when empty.
+		CgroupMemoryLimit bool
+		CgroupfsPath      string
+		// CmdlineInfo adds proc_cmdline_info, carrying the command line of
+		// the oldest process of a group as a label. CmdlineInfoMaxLength
+		// truncates it to as many characters, unless zero.
+		CmdlineInfo          bool
+		CmdlineInfoMaxLength int
+		// MembersByExe adds proc_members_by_exe, the number of processes
+		// of a group per argv[0]. Only the MembersByExe most common ones
+		// are kept, the others are summed up as "other". Disabled when 0.
+		MembersByExe int
+		// CloneSharedVM adds proc_clone_shared_vm, the number of processes
+		// of a group sharing their virtual memory with another process of
+		// the group, as created by clone(2) with CLONE_VM but without
+		// CLONE_THREAD. They are compared with kcmp(2), which requires
+		// ptrace access to both processes.
+		CloneSharedVM bool
+		// ThreadStates adds proc_thread_states, the number of threads in
+		// each scheduler state, from /proc/<pid>/task/<tid>/stat. It is
+		// dropped along with the other thread metrics by NoThreads.
+		ThreadStates bool
+		// CPUByThreadRole adds the threadrole label to
+		// proc_cpu_seconds_total, splitting the CPU time of every process
+		// into that of its main thread, whose TID is the PID, and that of
+		// the others, including exited ones, as "worker". It is ignored
+		// with NoThreads.
+		CPUByThreadRole bool
+		// NoThreads drops the thread metrics proc_num_threads,
+		// proc_max_threads_per_process and proc_threads_per_process.
+		NoThreads bool
+		// NoStartTime drops proc_oldest_start_time_seconds,
+		// proc_oldest_running_seconds and proc_newest_running_seconds.
+		NoStartTime bool
+		// NoFds drops proc_num_fds and proc_fd_limit, and skips reading
+		// the fds and limits of every process.
+		NoFds bool
+		// FdLimit adds proc_fd_limit, the soft limit on open files from
+		// /proc/<pid>/limits. It is dropped along with the other fd
+		// metrics by NoFds.
+		FdLimit bool
+		// AccountAllow restricts collection to processes owned by the listed
+		// users. All users are allowed when empty.
+		AccountAllow []string
+		// AccountDeny skips processes owned by the listed users, even if
+		// they are in AccountAllow.
+		AccountDeny []string
+		// Aggregations override the DefaultAggregations of metric families.
+		Aggregations map[string]Aggregation
+		// ScrapeTimeout stops reading processes once a scrape took that
+		// long, emitting the groups read so far. No limit when 0.
+		ScrapeTimeout time.Duration
+		// LegacyScrapeErrors also emits proc_scrape_errors, the former name
+		// of proc_scrape_errors_total, for dashboards and alerts not yet
+		// updated. It will be removed in the next release.
+		LegacyScrapeErrors bool
+		// ConstLabels are added to every series of the collector, like the
+		// procfs label of MultiProcCollector.
+		ConstLabels map[string]string
 	}
 
 	commMatcher struct {
 		comms map[string]struct{}
 	}
 
+	notCommMatcher struct {
+		commMatcher
+	}
+
+	commPrefixMatcher struct {
+		prefixes []string
+	}
+
+	commSuffixMatcher struct {
+		suffixes []string
+	}
+
 	exeMatcher struct {
 		exes map[string]string
 	}
 
+	ttyMatcher struct {
+		none bool
+		any  bool
+		ttys map[int]struct{}
+	}
+
+	containerMatcher struct {
+		regexes []*regexp.Regexp
+	}
+
+	systemdUnitMatcher struct{}
+
+	namespaceMatcher struct {
+		// types are the namespace types to compare, sorted.
+		types []string
+		// host maps each type to whether the process has to share the
+		// namespace of PID 1 (true) or not (false).
+		host map[string]bool
+	}
+
+	buildIDMatcher struct {
+		// cache holds the build IDs of executables by file, as they rarely
+		// change. It is cleared once it holds maxBuildIDs of them, so the
+		// IDs of replaced executables don't pile up.
+		mtx   sync.Mutex
+		cache map[buildIDKey]string
+	}
+
+	// buildIDKey identifies an executable by device, inode and
+	// modification time, so a binary replaced in place or reached through
+	// another path or mount namespace is told apart.
+	buildIDKey struct {
+		dev, ino uint64
+		mtime    int64
+	}
+
+	capabilityMatcher struct {
+		// mask has the bits of the configured capabilities set.
+		mask uint64
+	}
+
+	pidRange struct {
+		min, max int
+	}
+
+	// pidMatcher matches the PID, session ID or process group ID, as
+	// selected by key, against a list of ranges.
+	pidMatcher struct {
+		key    string
+		ranges []pidRange
+	}
+
+	ageMatcher struct {
+		minAge float64
+		// now returns the current time, time.Now unless pinned by tests.
+		now func() time.Time
+	}
+
+	listeningMatcher struct {
+		listening bool
+	}
+
+	fdUsageMatcher struct {
+		// above is the fraction of the soft fd limit the open fds have to
+		// exceed.
+		above float64
+	}
+
+	chrootMatcher struct {
+		chrooted bool
+	}
+
+	openFileMatcher struct {
+		regexes []*regexp.Regexp
+	}
+
 	cmdlineMatcher struct {
 		regexes []*regexp.Regexp
+		mode    string
+	}
+
+	argvMatcher struct {
+		indexes []int
+		regexes map[int]*regexp.Regexp
 	}
 
 	andMatcher []Matcher
@@ -56,45 +536,367 @@ type (
 	matchNamer struct {
 		andMatcher
 		templateNamer
+		// sampleRate restricts the entry to one in sampleRate processes,
+		// chosen by a hash of the PID. 1 selects all processes.
+		sampleRate uint32
+		// priority orders the entries of a config, highest first.
+		priority int
+		// account is the template of the account of the group, which is
+		// the owner of the process if nil.
+		account *template.Template
+		// maxCmdlineLen excludes processes whose command line, joined by
+		// spaces, is longer. No limit when 0.
+		maxCmdlineLen int
+		// exeTable names the processes whose resolved executable it
+		// holds, instead of the template. Unused if nil.
+		exeTable *exeTable
+	}
+
+	// exeTable maps resolved executable paths to group names, as read
+	// from a CSV or TSV file.
+	exeTable struct {
+		path  string
+		names map[string]string
+	}
+
+	// exeTableMatcher matches the processes whose resolved executable is
+	// in the table, for entries without other matchers.
+	exeTableMatcher struct {
+		table *exeTable
 	}
 
 	templateParams struct {
 		Comm    string
 		ExeBase string
 		ExeFull string
+		ExeReal string
+		UID     int
+		SID     int
+		PGID    int
+		Argc    int
+		Args    []string
 		Matches map[string]string
+
+		nacl NameAndCmdline
 	}
 )
 
+// root returns the procfs mount point the process is read from.
+func (nacl NameAndCmdline) root() string {
+	if nacl.procfsPath == "" {
+		return procfs.DefaultMountPoint
+	}
+	return nacl.procfsPath
+}
+
+// path returns the path of the named file of the process.
+func (nacl NameAndCmdline) path(name string) string {
+	return filepath.Join(nacl.root(), strconv.Itoa(nacl.PID), name)
+}
+
+// readFile returns the content of the named file of the process.
+func (nacl NameAndCmdline) readFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(nacl.path(name))
+}
+
+// exeReal returns the resolved path of the executable of the process, or an
+// empty string if it can't be read, e.g. for kernel threads. The suffix the
+// kernel adds when the binary was deleted or replaced is removed.
+func (nacl NameAndCmdline) exeReal() string {
+	exe, err := os.Readlink(nacl.path("exe"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(exe, " (deleted)")
+}
+
+// MatchAndNameAccount returns the outcome of m.MatchAndNameAccount if m is
+// an AccountMatchNamer, and that of m.MatchAndName with an empty account
+// otherwise.
+func MatchAndNameAccount(m MatchNamer, nacl NameAndCmdline) (bool, string, string) {
+	if am, ok := m.(AccountMatchNamer); ok {
+		return am.MatchAndNameAccount(nacl)
+	}
+	matched, name := m.MatchAndName(nacl)
+	return matched, name, ""
+}
+
+// MatchAndName returns the outcome of c.MatchNamers.MatchAndName.
+func (c *Config) MatchAndName(nacl NameAndCmdline) (bool, string) {
+	return c.MatchNamers.MatchAndName(nacl)
+}
+
+// Explain returns which entry of c names nacl when evaluated in order, as
+// with the default "first" match policy.
+func (c *Config) Explain(nacl NameAndCmdline) Explanation {
+	for i, m := range c.MatchNamers {
+		var matched bool
+		var name string
+		var matches map[string]string
+		if mn, ok := m.(*matchNamer); ok {
+			if matched, matches = mn.match(nacl); matched {
+				_, name = mn.MatchAndName(nacl)
+			}
+		} else {
+			matched, name = m.MatchAndName(nacl)
+		}
+		if matched {
+			return Explanation{Matched: true, Index: i, Name: name, Matches: matches}
+		}
+		if unsampled(m, nacl) {
+			return Explanation{Index: i}
+		}
+	}
+	return Explanation{Index: -1}
+}
+
 func (f FirstMatcher) MatchAndName(nacl NameAndCmdline) (bool, string) {
+	matched, name, _ := f.MatchAndNameAccount(nacl)
+	return matched, name
+}
+
+func (f FirstMatcher) MatchAndNameAccount(nacl NameAndCmdline) (bool, string, string) {
 	for _, m := range f {
-		if matched, name := m.MatchAndName(nacl); matched {
-			return true, name
+		if matched, name, account := MatchAndNameAccount(m, nacl); matched {
+			return true, name, account
+		}
+		if unsampled(m, nacl) {
+			return false, "", ""
+		}
+	}
+	return false, "", ""
+}
+
+func (f MostSpecificMatcher) MatchAndName(nacl NameAndCmdline) (bool, string) {
+	matched, name, _ := f.MatchAndNameAccount(nacl)
+	return matched, name
+}
+
+func (f MostSpecificMatcher) MatchAndNameAccount(nacl NameAndCmdline) (bool, string, string) {
+	var (
+		found   bool
+		ignored bool
+		best    string
+		account string
+		most    int
+	)
+	for _, m := range f {
+		matched, name, acc := MatchAndNameAccount(m, nacl)
+		if !matched && !unsampled(m, nacl) {
+			continue
+		}
+		// an unsampled entry wins like a matching one, and ignores the
+		// process
+		if s := specificity(m); !found || s > most {
+			found, ignored, best, account, most = true, !matched, name, acc, s
+		}
+	}
+	if ignored {
+		return false, "", ""
+	}
+	return found, best, account
+}
+
+// unsampled tells whether m is an entry matching the process but for its
+// sample rate. Such processes are ignored, rather than left to other
+// entries.
+func unsampled(m MatchNamer, nacl NameAndCmdline) bool {
+	mn, ok := m.(*matchNamer)
+	if !ok || mn.sampleRate <= 1 || sampled(nacl.PID, mn.sampleRate) {
+		return false
+	}
+	if mn.maxCmdlineLen > 0 && cmdlineLen(nacl.Cmdline) > mn.maxCmdlineLen {
+		return false
+	}
+	matched, _ := mn.Match(nacl)
+	return matched
+}
+
+// specificity returns the number of matchers of an entry, or 0 for other
+// MatchNamers.
+func specificity(m MatchNamer) int {
+	if mn, ok := m.(*matchNamer); ok {
+		return len(mn.andMatcher)
+	}
+	return 0
+}
+
+// matchAllNames returns the names of all config entries of m matching the
+// process, rather than only the one picked by m.
+func matchAllNames(m MatchNamer, nacl NameAndCmdline) []string {
+	var entries []MatchNamer
+	switch t := m.(type) {
+	case FirstMatcher:
+		entries = t
+	case MostSpecificMatcher:
+		entries = t
+	case NameSanitizer:
+		return matchAllNames(t.MatchNamer, nacl)
+	case NameTruncator:
+		return matchAllNames(t.MatchNamer, nacl)
+	default:
+		entries = []MatchNamer{m}
+	}
+
+	var names []string
+	for _, e := range entries {
+		if matched, name := e.MatchAndName(nacl); matched {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (s NameSanitizer) MatchAndName(nacl NameAndCmdline) (bool, string) {
+	matched, name, _ := s.MatchAndNameAccount(nacl)
+	return matched, name
+}
+
+// MatchAndNameAccount sanitizes the account as well as the name.
+func (s NameSanitizer) MatchAndNameAccount(nacl NameAndCmdline) (bool, string, string) {
+	matched, name, account := MatchAndNameAccount(s.MatchNamer, nacl)
+	if !matched {
+		return false, "", ""
+	}
+	sanitize := func(r rune) rune {
+		if strings.ContainsRune(s.Chars, r) {
+			return '_'
 		}
+		return r
 	}
-	return false, ""
+	return true, strings.Map(sanitize, name), strings.Map(sanitize, account)
+}
+
+// truncatedHashLen is the length of the suffix of truncated names, a dash
+// followed by the 32 bit FNV-1a hash of the full name in hex.
+const truncatedHashLen = 9
+
+func (t NameTruncator) MatchAndName(nacl NameAndCmdline) (bool, string) {
+	matched, name, _ := t.MatchAndNameAccount(nacl)
+	return matched, name
+}
+
+// MatchAndNameAccount truncates the name, but not the account.
+func (t NameTruncator) MatchAndNameAccount(nacl NameAndCmdline) (bool, string, string) {
+	matched, name, account := MatchAndNameAccount(t.MatchNamer, nacl)
+	if !matched {
+		return false, "", ""
+	}
+	return true, truncateName(name, t.MaxLength), account
+}
+
+// truncateName returns name if it has at most max characters, and otherwise
+// its beginning followed by a hash of all of it, max characters in total.
+func truncateName(name string, max int) string {
+	runes := []rune(name)
+	if max <= truncatedHashLen || len(runes) <= max {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("%s-%08x", string(runes[:max-truncatedHashLen]), h.Sum32())
 }
 
 func (m *matchNamer) MatchAndName(nacl NameAndCmdline) (bool, string) {
-	ok, matches := m.Match(nacl)
-	if !ok {
-		return false, ""
+	matched, name, _ := m.MatchAndNameAccount(nacl)
+	return matched, name
+}
+
+// match is like m.Match, also applying the sample rate and command line
+// length limit of m.
+func (m *matchNamer) match(nacl NameAndCmdline) (bool, map[string]string) {
+	if m.sampleRate > 1 && !sampled(nacl.PID, m.sampleRate) {
+		return false, nil
 	}
+	if m.maxCmdlineLen > 0 && cmdlineLen(nacl.Cmdline) > m.maxCmdlineLen {
+		return false, nil
+	}
+	return m.Match(nacl)
+}
 
-	exebase, exefull := nacl.Name, nacl.Name
-	if len(nacl.Cmdline) > 0 {
-		exefull = nacl.Cmdline[0]
-		exebase = filepath.Base(exefull)
+func (m *matchNamer) MatchAndNameAccount(nacl NameAndCmdline) (bool, string, string) {
+	ok, matches := m.match(nacl)
+	if !ok {
+		return false, "", ""
 	}
 
-	var buf bytes.Buffer
-	m.template.Execute(&buf, &templateParams{
+	exebase, exefull := nacl.exe()
+
+	params := &templateParams{
 		Comm:    nacl.Name,
 		ExeBase: exebase,
 		ExeFull: exefull,
+		ExeReal: nacl.exeReal(),
+		UID:     nacl.UID,
+		SID:     nacl.SID,
+		PGID:    nacl.PGID,
+		Argc:    len(nacl.Cmdline),
 		Matches: matches,
-	})
-	return true, buf.String()
+		nacl:    nacl,
+	}
+	if len(nacl.Cmdline) > 0 {
+		params.Args = nacl.Cmdline
+	}
+	var buf bytes.Buffer
+	m.template.Execute(&buf, params)
+	name := buf.String()
+	if m.exeTable != nil {
+		if n, ok := m.exeTable.names[params.ExeReal]; ok {
+			name = n
+		}
+	}
+	var account string
+	if m.account != nil {
+		var abuf bytes.Buffer
+		m.account.Execute(&abuf, params)
+		account = abuf.String()
+	}
+	return true, name, account
+}
+
+// cmdlineLen returns the length of the command line joined by spaces.
+func cmdlineLen(cmdline []string) int {
+	if len(cmdline) == 0 {
+		return 0
+	}
+	n := len(cmdline) - 1
+	for _, arg := range cmdline {
+		n += len(arg)
+	}
+	return n
+}
+
+// filtersAccounts reports whether there are account allow or deny lists.
+func (o Options) filtersAccounts() bool {
+	return len(o.AccountAllow) > 0 || len(o.AccountDeny) > 0
+}
+
+// accountWanted reports whether processes owned by account are collected,
+// according to the account allow and deny lists.
+func (o Options) accountWanted(account string) bool {
+	for _, a := range o.AccountDeny {
+		if a == account {
+			return false
+		}
+	}
+	if len(o.AccountAllow) == 0 {
+		return true
+	}
+	for _, a := range o.AccountAllow {
+		if a == account {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled reports whether the PID belongs to the deterministic one in rate
+// sample. The choice only depends on the PID, so a process is either always
+// or never part of the sample during its lifetime.
+func sampled(pid int, rate uint32) bool {
+	h := fnv.New32a()
+	h.Write([]byte(strconv.Itoa(pid)))
+	return h.Sum32()%rate == 0
 }
 
 func (m *commMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
@@ -102,11 +904,110 @@ func (m *commMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
 	return found, nil
 }
 
+// Match succeeds if the comm is not one of the configured ones. A process
+// with an empty comm is never matched, as it can't be told apart from the
+// excluded ones.
+func (m *notCommMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	if nacl.Name == "" {
+		return false, nil
+	}
+	found, _ := m.commMatcher.Match(nacl)
+	return !found, nil
+}
+
+func (m *commPrefixMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	for _, p := range m.prefixes {
+		if strings.HasPrefix(nacl.Name, p) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Match succeeds if the comm ends with any configured suffix. The kernel
+// truncates comm to 15 bytes, so the end of a longer name is not seen.
+func (m *commSuffixMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	for _, s := range m.suffixes {
+		if strings.HasSuffix(nacl.Name, s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SessionLeader returns the comm of the session leader of the process, or
+// an empty string if it has exited. It is read only when a name template
+// uses it.
+func (p *templateParams) SessionLeader() string {
+	leader := p.nacl
+	leader.PID = p.SID
+	data, err := leader.readFile("comm")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Username returns the name of the owner of the process, or an empty string
+// if it can't be looked up. Unless the collector looked it up already, to
+// filter accounts, it is looked up only when a template uses it.
+func (p *templateParams) Username() string {
+	if p.nacl.Username != "" {
+		return p.nacl.Username
+	}
+	account, _ := lookupAccount(p.nacl.UID)
+	return account
+}
+
+// lookupAccount returns the name of the user with the given UID.
+func lookupAccount(uid int) (string, error) {
+	if uid < 0 {
+		return "", fmt.Errorf("unknown owner")
+	}
+	account, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return "", err
+	}
+	return account.Username, nil
+}
+
+// Root returns the resolved /proc/<pid>/root link, the root directory of the
+// process as seen from the exporter, or an empty string if it can't be read.
+// It is read only when a name template uses it.
+func (p *templateParams) Root() string {
+	root, err := os.Readlink(p.nacl.path("root"))
+	if err != nil {
+		return ""
+	}
+	return root
+}
+
+// exe returns the basename and full path of the executable from argv[0].
+// Both are the comm for processes without a command line, such as kernel
+// threads.
+func (nacl NameAndCmdline) exe() (string, string) {
+	if len(nacl.Cmdline) == 0 {
+		return nacl.Name, nacl.Name
+	}
+	return exeBase(nacl.Cmdline[0]), nacl.Cmdline[0]
+}
+
+// exeBase returns the last element of an executable path. Unlike
+// filepath.Base it splits on backslashes too, as argv[0] may hold a Windows
+// style path, e.g. for processes started by cross-platform launchers.
+func exeBase(path string) string {
+	path = strings.TrimRight(path, `/\`)
+	if path == "" {
+		return ""
+	}
+	return path[strings.LastIndexAny(path, `/\`)+1:]
+}
+
 func (m *exeMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
 	if len(nacl.Cmdline) == 0 {
 		return false, nil
 	}
-	thisbase := filepath.Base(nacl.Cmdline[0])
+	thisbase := exeBase(nacl.Cmdline[0])
 	fqpath, found := m.exes[thisbase]
 	if !found {
 		return false, nil
@@ -115,19 +1016,532 @@ func (m *exeMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
 		return true, nil
 	}
 
-	return fqpath == nacl.Cmdline[0], nil
+	return fqpath == nacl.Cmdline[0], nil
+}
+
+func (m *ttyMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	var found bool
+	if nacl.TTY == 0 {
+		found = m.none
+	} else {
+		_, found = m.ttys[nacl.TTY]
+		found = found || m.any
+	}
+	if !found {
+		return false, nil
+	}
+	return true, map[string]string{"tty": strconv.Itoa(nacl.TTY)}
+}
+
+// Match succeeds if any regex matches the path of any cgroup the process
+// belongs to. The first capture group, or the whole match if there is none,
+// is returned as "container".
+func (m *containerMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	data, err := nacl.readFile("cgroup")
+	if err != nil {
+		return false, nil
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, regex := range m.regexes {
+			regexCaptures := regex.FindStringSubmatch(parts[2])
+			if regexCaptures == nil {
+				continue
+			}
+			container := regexCaptures[0]
+			if len(regexCaptures) > 1 {
+				container = regexCaptures[1]
+			}
+			return true, map[string]string{"container": container}
+		}
+	}
+	return false, nil
+}
+
+// Match succeeds if the process belongs to a systemd service or scope unit,
+// which is returned as "unit". For nested units, as in user sessions, the
+// innermost one is used.
+func (m systemdUnitMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	data, err := nacl.readFile("cgroup")
+	if err != nil {
+		return false, nil
+	}
+
+	var unit string
+	for _, line := range strings.Split(string(data), "\n") {
+		// hierarchy-ID:controller-list:cgroup-path, where the systemd
+		// hierarchy is name=systemd on cgroup v1 and the unified one on v2.
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 || (parts[1] != "name=systemd" && parts[1] != "") {
+			continue
+		}
+		// Service and scope units, including transient ones such as
+		// run-r1234.scope, are kept. Slices only group units.
+		for _, elem := range strings.Split(parts[2], "/") {
+			if strings.HasSuffix(elem, ".service") || strings.HasSuffix(elem, ".scope") {
+				unit = elem
+			}
+		}
+		if unit != "" {
+			break
+		}
+	}
+	if unit == "" {
+		return false, nil
+	}
+	return true, map[string]string{"unit": unit}
+}
+
+// Match succeeds if, for every configured namespace type, whether the process
+// shares the namespace with PID 1 equals the configured value. The inode of
+// each namespace is returned as "<type>_ns". Unreadable namespaces, e.g. of
+// processes owned by other users, never match.
+func (m *namespaceMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	initProc := nacl
+	initProc.PID = 1
+
+	matches := make(map[string]string, len(m.types))
+	for _, t := range m.types {
+		ns, err := readNamespace(nacl, t)
+		if err != nil {
+			return false, nil
+		}
+		hostNs, err := readNamespace(initProc, t)
+		if err != nil {
+			return false, nil
+		}
+		if (ns == hostNs) != m.host[t] {
+			return false, nil
+		}
+		matches[t+"_ns"] = ns
+	}
+	return true, matches
+}
+
+// Match succeeds if whether the root directory of the process differs from
+// that of PID 1 equals m.chrooted. Directories are compared by device and
+// inode, as the root link reads "/" for processes in another mount
+// namespace. Reading the root of PID 1 requires root, without it the root of
+// the exporter is used instead. The resolved root link is returned as
+// "root".
+func (m *chrootMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	initProc := nacl
+	initProc.PID = 1
+
+	root, err := os.Stat(nacl.path("root"))
+	if err != nil {
+		return false, nil
+	}
+	hostRoot, err := os.Stat(initProc.path("root"))
+	if err != nil {
+		if hostRoot, err = os.Stat("/"); err != nil {
+			return false, nil
+		}
+	}
+	if os.SameFile(root, hostRoot) == m.chrooted {
+		return false, nil
+	}
+	link, _ := os.Readlink(nacl.path("root"))
+	return true, map[string]string{"root": link}
+}
+
+// readNamespace returns the inode of the process namespace of type t, from
+// a /proc/<pid>/ns link like "pid:[4026531836]".
+func readNamespace(nacl NameAndCmdline, t string) (string, error) {
+	link, err := os.Readlink(nacl.path(filepath.Join("ns", t)))
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(link, t+":[") || !strings.HasSuffix(link, "]") {
+		return "", fmt.Errorf("unexpected namespace link %q", link)
+	}
+	return link[len(t)+2 : len(link)-1], nil
+}
+
+// Match succeeds if the executable of the process is an ELF file with a GNU
+// build ID, which is returned hex encoded as "buildid". Scripts, unreadable
+// executables and binaries built without a build ID never match.
+func (m *buildIDMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	exe := nacl.path("exe")
+	fi, err := os.Stat(exe)
+	if err != nil {
+		return false, nil
+	}
+	dev, ino, ok := fileID(fi)
+	if !ok {
+		return false, nil
+	}
+	key := buildIDKey{dev, ino, fi.ModTime().UnixNano()}
+
+	m.mtx.Lock()
+	id, ok := m.cache[key]
+	m.mtx.Unlock()
+	if !ok {
+		id = readBuildID(exe)
+		m.mtx.Lock()
+		if len(m.cache) >= maxBuildIDs {
+			m.cache = make(map[buildIDKey]string)
+		}
+		m.cache[key] = id
+		m.mtx.Unlock()
+	}
+	if id == "" {
+		return false, nil
+	}
+	return true, map[string]string{"buildid": id}
+}
+
+// readBuildID returns the hex encoded NT_GNU_BUILD_ID note of the named ELF
+// file, or an empty string if there is none.
+func readBuildID(path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_NOTE {
+			continue
+		}
+		data, err := ioutil.ReadAll(prog.Open())
+		if err != nil {
+			continue
+		}
+		if id := findBuildIDNote(data, f.ByteOrder); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// findBuildIDNote scans the notes of a PT_NOTE segment for the GNU build ID.
+// Each note is a header of name size, descriptor size and type, followed by
+// the name and the descriptor, both padded to 4 bytes.
+func findBuildIDNote(data []byte, order binary.ByteOrder) string {
+	const ntGNUBuildID = 3
+	align := func(n uint32) uint64 { return (uint64(n) + 3) &^ 3 }
+
+	for len(data) >= 12 {
+		namesz, descsz, typ := order.Uint32(data), order.Uint32(data[4:]), order.Uint32(data[8:])
+		data = data[12:]
+		if align(namesz)+align(descsz) > uint64(len(data)) {
+			return ""
+		}
+		name, desc := data[:namesz], data[align(namesz):align(namesz)+uint64(descsz)]
+		if typ == ntGNUBuildID && string(name) == "GNU\x00" {
+			return hex.EncodeToString(desc)
+		}
+		data = data[align(namesz)+align(descsz):]
+	}
+	return ""
+}
+
+// Match succeeds if the effective capabilities of the process include any of
+// the configured ones. Those present are returned as "capabilities", comma
+// separated.
+func (m capabilityMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	data, err := nacl.readFile("status")
+	if err != nil {
+		return false, nil
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		capEff, err := strconv.ParseUint(strings.TrimSpace(line[len("CapEff:"):]), 16, 64)
+		if err != nil || capEff&m.mask == 0 {
+			return false, nil
+		}
+		return true, map[string]string{"capabilities": strings.Join(decodeCapabilities(capEff&m.mask), ",")}
+	}
+	return false, nil
+}
+
+// decodeCapabilities returns the names of the capabilities in set, in bit
+// order. Bits without a known name are returned as their number.
+func decodeCapabilities(set uint64) []string {
+	var names []string
+	for bit := uint(0); bit < 64; bit++ {
+		if set&(1<<bit) == 0 {
+			continue
+		}
+		if int(bit) < len(capabilityNames) {
+			names = append(names, capabilityNames[bit])
+		} else {
+			names = append(names, strconv.Itoa(int(bit)))
+		}
+	}
+	return names
+}
+
+// Match succeeds if the ID selected by m.key is in any of the ranges. The ID
+// is returned under the key.
+func (m *pidMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	id := nacl.PID
+	switch m.key {
+	case "sid":
+		id = nacl.SID
+	case "pgid":
+		id = nacl.PGID
+	}
+	for _, r := range m.ranges {
+		if id >= r.min && id <= r.max {
+			return true, map[string]string{m.key: strconv.Itoa(id)}
+		}
+	}
+	return false, nil
+}
+
+// Match succeeds if the open fds of the process exceed m.above of its soft
+// fd limit. Processes whose fds or limit can't be read, or without a limit,
+// never match. The usage is returned as "fd_usage".
+func (m *fdUsageMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	fds, err := readDirNames(nacl.path("fd"))
+	if err != nil {
+		return false, nil
+	}
+	limit, err := readOpenFilesLimit(nacl.root(), nacl.PID)
+	if err != nil || limit <= 0 || math.IsInf(limit, 1) {
+		return false, nil
+	}
+	usage := float64(len(fds)) / limit
+	if usage <= m.above {
+		return false, nil
+	}
+	return true, map[string]string{"fd_usage": strconv.FormatFloat(usage, 'f', 2, 64)}
+}
+
+// readOpenFilesLimit returns the soft limit on open files of a process from
+// /proc/<pid>/limits, +Inf if unlimited.
+func readOpenFilesLimit(procfsPath string, pid int) (float64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procfsPath, strconv.Itoa(pid), "limits"))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// Max open files  <soft>  <hard>  files
+		if !strings.HasPrefix(line, "Max open files ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			break
+		}
+		if fields[3] == "unlimited" {
+			return math.Inf(1), nil
+		}
+		return strconv.ParseFloat(fields[3], 64)
+	}
+	return 0, fmt.Errorf("no open files limit for process %d", pid)
+}
+
+// Match succeeds if the process has been running for at least minAge
+// seconds. Processes of unknown start time never match.
+func (m *ageMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	if nacl.StartTime == 0 {
+		return false, nil
+	}
+	age := float64(m.now().UnixNano())/1e9 - nacl.StartTime
+	return age >= m.minAge, nil
+}
+
+// Match succeeds if the resolved executable of the process is in the table.
+func (m *exeTableMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	_, ok := m.table.names[nacl.exeReal()]
+	return ok, nil
+}
+
+// Match succeeds if whether the process has a TCP socket in LISTEN state
+// equals m.listening. The listening ports are returned as "port", the lowest
+// one, and "ports", all of them comma-separated.
+func (m *listeningMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	ports := listeningPorts(nacl)
+	if (len(ports) > 0) != m.listening {
+		return false, nil
+	}
+	if len(ports) == 0 {
+		return true, nil
+	}
+
+	strs := make([]string, len(ports))
+	for i, p := range ports {
+		strs[i] = strconv.Itoa(p)
+	}
+	return true, map[string]string{
+		"port":  strs[0],
+		"ports": strings.Join(strs, ","),
+	}
+}
+
+// listeningPorts returns the sorted TCP ports the process listens on. The
+// socket inodes from its fd links are joined with the LISTEN entries of the
+// tcp tables of its network namespace. Unreadable fds yield no ports.
+func listeningPorts(nacl NameAndCmdline) []int {
+	targets, err := fdTargets(nacl)
+	if err != nil {
+		return nil
+	}
+
+	inodes := make(map[string]struct{})
+	for _, target := range targets {
+		if strings.HasPrefix(target, "socket:[") && strings.HasSuffix(target, "]") {
+			inodes[target[len("socket:["):len(target)-1]] = struct{}{}
+		}
+	}
+	if len(inodes) == 0 {
+		return nil
+	}
+
+	seen := make(map[int]struct{})
+	var ports []int
+	for _, table := range []string{"net/tcp", "net/tcp6"} {
+		data, err := nacl.readFile(table)
+		if err != nil {
+			continue
+		}
+		for _, port := range parseListeningPorts(string(data), inodes) {
+			if _, ok := seen[port]; !ok {
+				seen[port] = struct{}{}
+				ports = append(ports, port)
+			}
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// parseListeningPorts returns the local ports of the LISTEN entries of a
+// /proc/net/tcp or tcp6 table whose inode is one of inodes.
+func parseListeningPorts(table string, inodes map[string]struct{}) []int {
+	const tcpListen = "0A"
+
+	var ports []int
+	for _, line := range strings.Split(table, "\n") {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ...
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[3] != tcpListen {
+			continue
+		}
+		if _, ok := inodes[fields[9]]; !ok {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			continue
+		}
+		port, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			continue
+		}
+		ports = append(ports, int(port))
+	}
+	return ports
+}
+
+// Match succeeds if any regex matches the target of any fd link of the
+// process, like "/dev/nvidia0" or "socket:[1234]". The lowest matching target
+// is returned as "open_file". The fds of processes owned by other users can
+// only be read as root, those never match.
+func (m *openFileMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	targets, err := fdTargets(nacl)
+	if err != nil {
+		return false, nil
+	}
+
+	// the same target for every scrape, as fd order varies
+	sort.Strings(targets)
+	for _, target := range targets {
+		for _, regex := range m.regexes {
+			if regex.MatchString(target) {
+				return true, map[string]string{"open_file": target}
+			}
+		}
+	}
+	return false, nil
+}
+
+// fdTargets returns the targets of the fd links of the process. fds closed
+// while reading are skipped.
+func fdTargets(nacl NameAndCmdline) ([]string, error) {
+	fdDir := nacl.path("fd")
+	names, err := readDirNames(fdDir)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]string, 0, len(names))
+	for _, name := range names {
+		target, err := os.Readlink(filepath.Join(fdDir, name))
+		if err != nil {
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// fdType classifies an fd by its link target as "socket", "pipe", "anon"
+// for anonymous inodes like eventfds and epoll instances, "file" for paths,
+// including devices, or "other", e.g. for memfds of newer kernels.
+func fdType(target string) string {
+	switch {
+	case strings.HasPrefix(target, "socket:["):
+		return "socket"
+	case strings.HasPrefix(target, "pipe:["):
+		return "pipe"
+	case strings.HasPrefix(target, "anon_inode:"):
+		return "anon"
+	case strings.HasPrefix(target, "/"):
+		return "file"
+	}
+	return "other"
+}
+
+// readDirNames returns the names of the entries of the directory.
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
 }
 
 func (m *cmdlineMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
 	matches := make(map[string]string)
+	logMismatches := LogMismatches
 
 	for _, regex := range m.regexes {
-		regexCaptures := regex.FindStringSubmatch(strings.Join(nacl.Cmdline, " "))
+		var regexCaptures []string
+		switch m.mode {
+		case cmdlineModeArgs:
+			for _, arg := range nacl.Cmdline {
+				if regexCaptures = regex.FindStringSubmatch(arg); regexCaptures != nil {
+					break
+				}
+			}
+		case cmdlineModeNul:
+			regexCaptures = regex.FindStringSubmatch(strings.Join(nacl.Cmdline, "\x00"))
+		default:
+			regexCaptures = regex.FindStringSubmatch(strings.Join(nacl.Cmdline, " "))
+		}
 		if regexCaptures == nil {
+			if logMismatches {
+				log.Debugf("Cmdline regex %q doesn't match process %d: %q", regex, nacl.PID, nacl.Cmdline)
+			}
 			return false, nil
 		}
 		subexpNames := regex.SubexpNames()
 		if len(subexpNames) != len(regexCaptures) {
+			log.Debugf("Cmdline regex %q has %d groups but %d captures for process %d", regex, len(subexpNames), len(regexCaptures), nacl.PID)
 			return false, nil
 		}
 
@@ -138,6 +1552,30 @@ func (m *cmdlineMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
 	return true, matches
 }
 
+func (m *argvMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
+	matches := make(map[string]string)
+
+	for _, idx := range m.indexes {
+		if idx >= len(nacl.Cmdline) {
+			return false, nil
+		}
+		arg := nacl.Cmdline[idx]
+		regex := m.regexes[idx]
+		regexCaptures := regex.FindStringSubmatch(arg)
+		if regexCaptures == nil {
+			return false, nil
+		}
+
+		for i, name := range regex.SubexpNames() {
+			if i > 0 && name != "" {
+				matches[name] = regexCaptures[i]
+			}
+		}
+		matches[fmt.Sprintf("argv%d", idx)] = arg
+	}
+	return true, matches
+}
+
 func (m andMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
 	allMatches := make(map[string]string)
 	for _, matcher := range m {
@@ -154,12 +1592,226 @@ func (m andMatcher) Match(nacl NameAndCmdline) (bool, map[string]string) {
 	return true, allMatches
 }
 
-// ReadRecipesFile opens the named file and extracts recipes from it.
+// The MarshalJSON methods below describe the parsed config with the keys of
+// the config file, to inspect the loaded entries. Each matcher yields the
+// keys it was built from, which matchNamer merges into one object per entry.
+
+func (m *matchNamer) MarshalJSON() ([]byte, error) {
+	entry := map[string]interface{}{
+		"name":     m.templateNamer,
+		"priority": m.priority,
+	}
+	if m.sampleRate > 1 {
+		entry["sample_rate"] = m.sampleRate
+	}
+	if m.maxCmdlineLen > 0 {
+		entry["max_cmdline_len"] = m.maxCmdlineLen
+	}
+	if m.account != nil {
+		entry["account"] = m.account.Tree.Root.String()
+	}
+	if m.exeTable != nil {
+		entry["exe_table"] = m.exeTable.path
+	}
+	for _, matcher := range m.andMatcher {
+		data, err := json.Marshal(matcher)
+		if err != nil {
+			return nil, err
+		}
+		var keys map[string]json.RawMessage
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return nil, err
+		}
+		for k, v := range keys {
+			entry[k] = v
+		}
+	}
+	return json.Marshal(entry)
+}
+
+func (t templateNamer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.template.Tree.Root.String())
+}
+
+func (m *commMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string][]string{"comm": setKeys(m.comms)})
+}
+
+func (m *notCommMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string][]string{"not_comm": setKeys(m.comms)})
+}
+
+func (m *commPrefixMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string][]string{"comm_prefix": m.prefixes})
+}
+
+func (m *commSuffixMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string][]string{"comm_suffix": m.suffixes})
+}
+
+func (m *exeMatcher) MarshalJSON() ([]byte, error) {
+	var exes []string
+	for base, full := range m.exes {
+		if full == "" {
+			full = base
+		}
+		exes = append(exes, full)
+	}
+	sort.Strings(exes)
+	return json.Marshal(map[string][]string{"exe": exes})
+}
+
+func (m *ttyMatcher) MarshalJSON() ([]byte, error) {
+	var ttys []int
+	for t := range m.ttys {
+		ttys = append(ttys, t)
+	}
+	sort.Ints(ttys)
+
+	var vals []string
+	if m.none {
+		vals = append(vals, "none")
+	}
+	if m.any {
+		vals = append(vals, "any")
+	}
+	for _, t := range ttys {
+		vals = append(vals, strconv.Itoa(t))
+	}
+	return json.Marshal(map[string][]string{"tty": vals})
+}
+
+func (m *containerMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string][]string{"container": regexStrings(m.regexes)})
+}
+
+func (m systemdUnitMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]bool{"systemd_unit": true})
+}
+
+func (m *namespaceMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]map[string]bool{"namespace": m.host})
+}
+
+func (m *buildIDMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]bool{"build_id": true})
+}
+
+func (m capabilityMatcher) MarshalJSON() ([]byte, error) {
+	var caps []string
+	for i, name := range capabilityNames {
+		if m.mask&(1<<uint(i)) != 0 {
+			caps = append(caps, "CAP_"+strings.ToUpper(name))
+		}
+	}
+	return json.Marshal(map[string][]string{"capability": caps})
+}
+
+func (m *pidMatcher) MarshalJSON() ([]byte, error) {
+	ranges := make([]string, len(m.ranges))
+	for i, r := range m.ranges {
+		if r.min == r.max {
+			ranges[i] = strconv.Itoa(r.min)
+		} else {
+			ranges[i] = fmt.Sprintf("%d-%d", r.min, r.max)
+		}
+	}
+	return json.Marshal(map[string][]string{m.key: ranges})
+}
+
+func (m *fdUsageMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]float64{"fd_usage_above": m.above})
+}
+
+func (m *ageMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]float64{"min_age_seconds": m.minAge})
+}
+
+func (m *listeningMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]bool{"listening": m.listening})
+}
+
+func (m *exeTableMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"exe_table": m.table.path})
+}
+
+func (m *chrootMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]bool{"chrooted": m.chrooted})
+}
+
+func (m *openFileMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string][]string{"open_file": regexStrings(m.regexes)})
+}
+
+func (m *cmdlineMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"cmdline":      regexStrings(m.regexes),
+		"cmdline_mode": m.mode,
+	})
+}
+
+func (m *argvMatcher) MarshalJSON() ([]byte, error) {
+	argv := make(map[int]string, len(m.regexes))
+	for idx, r := range m.regexes {
+		argv[idx] = r.String()
+	}
+	return json.Marshal(map[string]map[int]string{"argv": argv})
+}
+
+// setKeys returns the sorted keys of set.
+func setKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// regexStrings returns the source text of the regexes.
+func regexStrings(rs []*regexp.Regexp) []string {
+	strs := make([]string, len(rs))
+	for i, r := range rs {
+		strs[i] = r.String()
+	}
+	return strs
+}
+
+// ReadConfig opens the named file and extracts the Config from it. Gzip
+// compressed files are decompressed transparently. Files named *.toml or
+// *.toml.gz are parsed as TOML, all others as YAML.
 func ReadConfig(cfgpath string) (*Config, error) {
+	return readConfig(cfgpath, false)
+}
+
+// ReadConfigExpandEnv is like ReadConfig, but replaces references to
+// environment variables like $VAR or ${VAR} by their values before parsing,
+// as os.ExpandEnv does.
+func ReadConfigExpandEnv(cfgpath string) (*Config, error) {
+	return readConfig(cfgpath, true)
+}
+
+func readConfig(cfgpath string, expandEnv bool) (*Config, error) {
 	content, err := ioutil.ReadFile(cfgpath)
 	if err != nil {
 		return nil, err
 	}
+	if bytes.HasPrefix(content, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing config: %v", err)
+		}
+		content, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing config: %v", err)
+		}
+	}
+	if expandEnv {
+		content = []byte(os.ExpandEnv(string(content)))
+	}
+	if filepath.Ext(strings.TrimSuffix(cfgpath, ".gz")) == ".toml" {
+		return GetTOMLConfig(string(content))
+	}
 	return GetConfig(string(content))
 }
 
@@ -171,13 +1823,62 @@ func GetConfig(content string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	yamlProcnames, ok := yamldata["process_names"]
+	return buildConfig(yamldata, "YAML")
+}
+
+// GetTOMLConfig extracts Config from content by parsing it as TOML. The
+// process_names list is an array of tables with the same keys as in YAML.
+func GetTOMLConfig(content string) (*Config, error) {
+	var tomldata map[string]interface{}
+
+	_, err := toml.Decode(content, &tomldata)
+	if err != nil {
+		return nil, err
+	}
+	yamldata := make(map[string]interface{}, len(tomldata))
+	for k, v := range tomldata {
+		yamldata[k] = fromTOML(v)
+	}
+	return buildConfig(yamldata, "TOML")
+}
+
+// fromTOML converts a decoded TOML value to the types the YAML decoder
+// produces, so that both formats share getMatchNamer.
+func fromTOML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int64:
+		return int(v)
+	case map[string]interface{}:
+		m := make(map[interface{}]interface{}, len(v))
+		for k, mv := range v {
+			m[k] = fromTOML(mv)
+		}
+		return m
+	case []map[string]interface{}:
+		l := make([]interface{}, len(v))
+		for i, lv := range v {
+			l[i] = fromTOML(lv)
+		}
+		return l
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, lv := range v {
+			l[i] = fromTOML(lv)
+		}
+		return l
+	}
+	return v
+}
+
+// buildConfig extracts Config from a parsed config file.
+func buildConfig(data map[string]interface{}, format string) (*Config, error) {
+	rawProcnames, ok := data["process_names"]
 	if !ok {
-		return nil, fmt.Errorf("error parsing YAML config: no top-level 'process_names' key")
+		return nil, fmt.Errorf("error parsing %s config: no top-level 'process_names' key", format)
 	}
-	procnames, ok := yamlProcnames.([]interface{})
+	procnames, ok := rawProcnames.([]interface{})
 	if !ok {
-		return nil, fmt.Errorf("error parsing YAML config: 'process_names' is not a list")
+		return nil, fmt.Errorf("error parsing %s config: 'process_names' is not a list", format)
 	}
 
 	var cfg Config
@@ -187,7 +1888,14 @@ func GetConfig(content string) (*Config, error) {
 			return nil, fmt.Errorf("unable to parse process_name entry %d: %v", i, err)
 		}
 		cfg.MatchNamers = append(cfg.MatchNamers, mn)
+		if t := mn.(*matchNamer).exeTable; t != nil {
+			cfg.ExeTables = append(cfg.ExeTables, t.path)
+		}
 	}
+	// entries of equal priority stay in config order
+	sort.SliceStable(cfg.MatchNamers, func(i, j int) bool {
+		return cfg.MatchNamers[i].(*matchNamer).priority > cfg.MatchNamers[j].(*matchNamer).priority
+	})
 
 	return &cfg, nil
 }
@@ -199,7 +1907,22 @@ func getMatchNamer(yamlmn interface{}) (MatchNamer, error) {
 	}
 
 	var smap = make(map[string][]string)
+	var argv map[int]string
 	var nametmpl string
+	var cmdlineMode = cmdlineModeSpace
+	var listening *bool
+	var chrooted *bool
+	var sampleRate = 1
+	var priority int
+	var maxCmdlineLen int
+	var account string
+	var exeTablePath string
+	var systemdUnit bool
+	var buildID bool
+	var minAge float64
+	var fdUsageAbove *float64
+	var pids []Matcher
+	var namespaces *namespaceMatcher
 	for k, v := range nm {
 		key, ok := k.(string)
 		if !ok {
@@ -212,6 +1935,112 @@ func getMatchNamer(yamlmn interface{}) (MatchNamer, error) {
 				return nil, fmt.Errorf("non-string value %v for key %q", v, key)
 			}
 			nametmpl = value
+		} else if key == "cmdline_mode" {
+			value, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string value %v for key %q", v, key)
+			}
+			switch value {
+			case cmdlineModeSpace, cmdlineModeNul, cmdlineModeArgs:
+				cmdlineMode = value
+			default:
+				return nil, fmt.Errorf("unknown cmdline_mode %q", value)
+			}
+		} else if key == "sample_rate" {
+			value, ok := v.(int)
+			if !ok || value < 1 {
+				return nil, fmt.Errorf("non-positive integer value %v for key %q", v, key)
+			}
+			sampleRate = value
+		} else if key == "account" {
+			value, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string value %v for key %q", v, key)
+			}
+			account = value
+		} else if key == "exe_table" {
+			value, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string value %v for key %q", v, key)
+			}
+			exeTablePath = value
+		} else if key == "max_cmdline_len" {
+			value, ok := v.(int)
+			if !ok || value < 1 {
+				return nil, fmt.Errorf("non-positive integer value %v for key %q", v, key)
+			}
+			maxCmdlineLen = value
+		} else if key == "priority" {
+			value, ok := v.(int)
+			if !ok {
+				return nil, fmt.Errorf("non-integer value %v for key %q", v, key)
+			}
+			priority = value
+		} else if key == "pid" || key == "sid" || key == "pgid" {
+			pm, err := getPidRanges(v, key)
+			if err != nil {
+				return nil, err
+			}
+			pids = append(pids, pm)
+		} else if key == "min_age_seconds" {
+			switch value := v.(type) {
+			case int:
+				minAge = float64(value)
+			case float64:
+				minAge = value
+			default:
+				return nil, fmt.Errorf("non-numeric value %v for key %q", v, key)
+			}
+		} else if key == "fd_usage_above" {
+			var value float64
+			switch v := v.(type) {
+			case int:
+				value = float64(v)
+			case float64:
+				value = v
+			default:
+				return nil, fmt.Errorf("non-numeric value %v for key %q", v, key)
+			}
+			if value < 0 || value >= 1 {
+				return nil, fmt.Errorf("value %v for key %q is not between 0 and 1", v, key)
+			}
+			fdUsageAbove = &value
+		} else if key == "systemd_unit" {
+			value, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("non-boolean value %v for key %q", v, key)
+			}
+			systemdUnit = value
+		} else if key == "build_id" {
+			value, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("non-boolean value %v for key %q", v, key)
+			}
+			buildID = value
+		} else if key == "listening" {
+			value, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("non-boolean value %v for key %q", v, key)
+			}
+			listening = &value
+		} else if key == "chrooted" {
+			value, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("non-boolean value %v for key %q", v, key)
+			}
+			chrooted = &value
+		} else if key == "namespace" {
+			var err error
+			namespaces, err = getNamespaceMatcher(v)
+			if err != nil {
+				return nil, err
+			}
+		} else if key == "argv" {
+			var err error
+			argv, err = getArgvMap(v)
+			if err != nil {
+				return nil, err
+			}
 		} else {
 			vals, ok := v.([]interface{})
 			if !ok {
@@ -220,6 +2049,10 @@ func getMatchNamer(yamlmn interface{}) (MatchNamer, error) {
 			var strs []string
 			for i, si := range vals {
 				s, ok := si.(string)
+				// tty numbers may be written unquoted
+				if n, isInt := si.(int); isInt && key == "tty" {
+					s, ok = strconv.Itoa(n), true
+				}
 				if !ok {
 					return nil, fmt.Errorf("non-string value %v in list[%d] for key %q", v, i, key)
 				}
@@ -237,17 +2070,76 @@ func getMatchNamer(yamlmn interface{}) (MatchNamer, error) {
 		}
 		matchers = append(matchers, &commMatcher{comms})
 	}
+	if notComm, ok := smap["not_comm"]; ok {
+		comms := make(map[string]struct{})
+		for _, c := range notComm {
+			comms[c] = struct{}{}
+		}
+		matchers = append(matchers, &notCommMatcher{commMatcher{comms}})
+	}
+	if prefixes, ok := smap["comm_prefix"]; ok {
+		matchers = append(matchers, &commPrefixMatcher{prefixes})
+	}
+	if suffixes, ok := smap["comm_suffix"]; ok {
+		matchers = append(matchers, &commSuffixMatcher{suffixes})
+	}
 	if exe, ok := smap["exe"]; ok {
 		exes := make(map[string]string)
 		for _, e := range exe {
-			if strings.Contains(e, "/") {
-				exes[filepath.Base(e)] = e
+			if strings.ContainsAny(e, `/\`) {
+				exes[exeBase(e)] = e
 			} else {
 				exes[e] = ""
 			}
 		}
 		matchers = append(matchers, &exeMatcher{exes})
 	}
+	if tty, ok := smap["tty"]; ok {
+		tm := &ttyMatcher{ttys: make(map[int]struct{})}
+		for _, t := range tty {
+			switch t {
+			case "none":
+				tm.none = true
+			case "any":
+				tm.any = true
+			default:
+				n, err := strconv.Atoi(t)
+				if err != nil {
+					return nil, fmt.Errorf("bad tty %q: not none, any or a tty number", t)
+				}
+				tm.ttys[n] = struct{}{}
+			}
+		}
+		matchers = append(matchers, tm)
+	}
+	if container, ok := smap["container"]; ok {
+		var rs []*regexp.Regexp
+		for _, c := range container {
+			r, err := regexp.Compile(c)
+			if err != nil {
+				return nil, fmt.Errorf("bad container regex %q: %v", c, err)
+			}
+			rs = append(rs, r)
+		}
+		matchers = append(matchers, &containerMatcher{rs})
+	}
+	if capability, ok := smap["capability"]; ok {
+		var cm capabilityMatcher
+		for _, c := range capability {
+			bit := -1
+			name := strings.TrimPrefix(strings.ToLower(c), "cap_")
+			for i, n := range capabilityNames {
+				if n == name {
+					bit = i
+				}
+			}
+			if bit < 0 {
+				return nil, fmt.Errorf("unknown capability %q", c)
+			}
+			cm.mask |= 1 << uint(bit)
+		}
+		matchers = append(matchers, cm)
+	}
 	if cmdline, ok := smap["cmdline"]; ok {
 		var rs []*regexp.Regexp
 		for _, c := range cmdline {
@@ -259,13 +2151,78 @@ func getMatchNamer(yamlmn interface{}) (MatchNamer, error) {
 		}
 		matchers = append(matchers, &cmdlineMatcher{
 			regexes: rs,
+			mode:    cmdlineMode,
 		})
 	}
+	if argv != nil {
+		am := &argvMatcher{regexes: make(map[int]*regexp.Regexp)}
+		for idx, a := range argv {
+			r, err := regexp.Compile(a)
+			if err != nil {
+				return nil, fmt.Errorf("bad argv regex %q for index %d: %v", a, idx, err)
+			}
+			am.indexes = append(am.indexes, idx)
+			am.regexes[idx] = r
+		}
+		sort.Ints(am.indexes)
+		matchers = append(matchers, am)
+	}
+	// in a fixed order, as map iteration above is random
+	sort.Slice(pids, func(i, j int) bool {
+		return pids[i].(*pidMatcher).key < pids[j].(*pidMatcher).key
+	})
+	matchers = append(matchers, pids...)
+	if namespaces != nil {
+		matchers = append(matchers, namespaces)
+	}
+	if chrooted != nil {
+		matchers = append(matchers, &chrootMatcher{*chrooted})
+	}
+	if systemdUnit {
+		matchers = append(matchers, systemdUnitMatcher{})
+	}
+	if buildID {
+		matchers = append(matchers, &buildIDMatcher{cache: make(map[buildIDKey]string)})
+	}
+	if minAge > 0 {
+		matchers = append(matchers, &ageMatcher{minAge, time.Now})
+	}
+	// Last, so that cheaper matchers can rule out a process first.
+	if fdUsageAbove != nil {
+		matchers = append(matchers, &fdUsageMatcher{*fdUsageAbove})
+	}
+	if openFile, ok := smap["open_file"]; ok {
+		var rs []*regexp.Regexp
+		for _, o := range openFile {
+			r, err := regexp.Compile(o)
+			if err != nil {
+				return nil, fmt.Errorf("bad open_file regex %q: %v", o, err)
+			}
+			rs = append(rs, r)
+		}
+		matchers = append(matchers, &openFileMatcher{rs})
+	}
+	if listening != nil {
+		matchers = append(matchers, &listeningMatcher{*listening})
+	}
+	var table *exeTable
+	if exeTablePath != "" {
+		var err error
+		table, err = readExeTable(exeTablePath)
+		if err != nil {
+			return nil, fmt.Errorf("bad exe_table %q: %v", exeTablePath, err)
+		}
+		if len(matchers) == 0 {
+			matchers = append(matchers, &exeTableMatcher{table})
+		}
+	}
 	if len(matchers) == 0 {
 		return nil, fmt.Errorf("no matchers provided")
 	}
 
-	if nametmpl == "" {
+	if nametmpl == "" && systemdUnit {
+		nametmpl = "{{.Matches.unit}}"
+	} else if nametmpl == "" {
 		nametmpl = "{{.ExeBase}}"
 	}
 	tmpl := template.New("cmdname")
@@ -274,5 +2231,148 @@ func getMatchNamer(yamlmn interface{}) (MatchNamer, error) {
 		return nil, fmt.Errorf("bad name template %q: %v", nametmpl, err)
 	}
 
-	return &matchNamer{matchers, templateNamer{tmpl}}, nil
+	var accountTmpl *template.Template
+	if account != "" {
+		accountTmpl, err = template.New("account").Parse(account)
+		if err != nil {
+			return nil, fmt.Errorf("bad account template %q: %v", account, err)
+		}
+	}
+
+	return &matchNamer{matchers, templateNamer{tmpl}, uint32(sampleRate), priority, accountTmpl, maxCmdlineLen, table}, nil
+}
+
+// readExeTable reads a table of executable paths and group names, one pair
+// per line. Files ending in .tsv are tab separated, others comma separated.
+// Lines starting with # are skipped.
+func readExeTable(path string) (*exeTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	if filepath.Ext(path) == ".tsv" {
+		r.Comma = '\t'
+	}
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &exeTable{path: path, names: make(map[string]string, len(records))}
+	for _, record := range records {
+		exe, name := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if exe == "" || name == "" {
+			return nil, fmt.Errorf("empty executable or name in %q", strings.Join(record, string(r.Comma)))
+		}
+		t.names[exe] = name
+	}
+	return t, nil
+}
+
+// getPidRanges converts the YAML value of a pid, sid or pgid key, a list of
+// IDs and ranges like "1000-2000", into a pidMatcher.
+func getPidRanges(v interface{}, key string) (*pidMatcher, error) {
+	vals, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("non-array value %v for key %q", v, key)
+	}
+
+	pm := &pidMatcher{key: key}
+	for i, val := range vals {
+		switch pid := val.(type) {
+		case int:
+			pm.ranges = append(pm.ranges, pidRange{pid, pid})
+		case string:
+			bounds := strings.SplitN(pid, "-", 2)
+			min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+			if err != nil {
+				return nil, fmt.Errorf("bad pid range %q in list[%d]", pid, i)
+			}
+			max := min
+			if len(bounds) == 2 {
+				max, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+				if err != nil || max < min {
+					return nil, fmt.Errorf("bad pid range %q in list[%d]", pid, i)
+				}
+			}
+			pm.ranges = append(pm.ranges, pidRange{min, max})
+		default:
+			return nil, fmt.Errorf("non-pid value %v in list[%d] for key %q", val, i, key)
+		}
+	}
+	return pm, nil
+}
+
+// namespaceTypes are the entries of /proc/<pid>/ns the namespace key accepts.
+var namespaceTypes = map[string]struct{}{
+	"cgroup": {}, "ipc": {}, "mnt": {}, "net": {}, "pid": {}, "user": {}, "uts": {},
+}
+
+// getNamespaceMatcher converts the YAML value of a namespace key, a map from
+// namespace type to whether it is the host one, into a namespaceMatcher.
+func getNamespaceMatcher(v interface{}) (*namespaceMatcher, error) {
+	ym, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("non-map value %v for key %q", v, "namespace")
+	}
+
+	m := &namespaceMatcher{host: make(map[string]bool)}
+	for k, v := range ym {
+		t, ok := k.(string)
+		if _, known := namespaceTypes[t]; !ok || !known {
+			return nil, fmt.Errorf("unknown namespace type %v", k)
+		}
+		host, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("non-boolean value %v for namespace type %q", v, t)
+		}
+		m.types = append(m.types, t)
+		m.host[t] = host
+	}
+	if len(m.types) == 0 {
+		return nil, fmt.Errorf("no namespace types provided")
+	}
+	sort.Strings(m.types)
+	return m, nil
+}
+
+// getArgvMap converts the YAML value of an argv key, a map from argument
+// index to regex, into a map keyed by int.
+func getArgvMap(v interface{}) (map[int]string, error) {
+	ym, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("non-map value %v for key %q", v, "argv")
+	}
+
+	argv := make(map[int]string)
+	for k, v := range ym {
+		var idx int
+		switch key := k.(type) {
+		case int:
+			idx = key
+		case string:
+			i, err := strconv.Atoi(key)
+			if err != nil {
+				return nil, fmt.Errorf("non-integer argv index %q", key)
+			}
+			idx = i
+		default:
+			return nil, fmt.Errorf("non-integer argv index %v", k)
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("negative argv index %d", idx)
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("non-string value %v for argv index %d", v, idx)
+		}
+		argv[idx] = s
+	}
+	return argv, nil
 }
@@ -0,0 +1,541 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mustGetConfig parses a YAML config or fails the test.
+func mustGetConfig(t *testing.T, content string) *Config {
+	t.Helper()
+	cfg, err := GetConfig(content)
+	if err != nil {
+		t.Fatalf("GetConfig(%q): %v", content, err)
+	}
+	return cfg
+}
+
+func TestCmdlineMode(t *testing.T) {
+	var (
+		quoted = []string{"app", "--msg=hello world"}
+		split  = []string{"app", "--msg=hello", "world"}
+	)
+	for _, tc := range []struct {
+		mode    string
+		regex   string
+		cmdline []string
+		want    bool
+	}{
+		// joined with spaces, both look the same
+		{"", `--msg=hello world`, quoted, true},
+		{"", `--msg=hello world`, split, true},
+		{"space", `--msg=hello world$`, split, true},
+		{"nul", `--msg=hello world`, quoted, true},
+		{"nul", `--msg=hello world`, split, false},
+		{"nul", `--msg=hello\x00world`, split, true},
+		{"nul", `--msg=hello\x00world`, quoted, false},
+		{"args", `^--msg=hello world$`, quoted, true},
+		{"args", `^--msg=hello world$`, split, false},
+		{"args", `^world$`, split, true},
+	} {
+		content := `
+process_names:
+  - name: "{{.Comm}}"
+    cmdline:
+    - '` + tc.regex + `'
+`
+		if tc.mode != "" {
+			content += "    cmdline_mode: " + tc.mode + "\n"
+		}
+		cfg := mustGetConfig(t, content)
+		nacl := NameAndCmdline{Name: "app", Cmdline: tc.cmdline}
+		if got, _ := cfg.MatchAndName(nacl); got != tc.want {
+			t.Errorf("mode %q, regex %q, cmdline %q: matched = %v, want %v", tc.mode, tc.regex, tc.cmdline, got, tc.want)
+		}
+	}
+
+	if _, err := GetConfig(`
+process_names:
+  - cmdline: [x]
+    cmdline_mode: tabs
+`); err == nil || !strings.Contains(err.Error(), "unknown cmdline_mode") {
+		t.Errorf("GetConfig() with cmdline_mode tabs = %v, want unknown cmdline_mode error", err)
+	}
+}
+
+func TestNotComm(t *testing.T) {
+	cfg := mustGetConfig(t, `
+process_names:
+  - name: "java-{{.Comm}}"
+    not_comm: [kafka, zookeeper]
+    cmdline: ['-jar ']
+  - name: "other"
+    not_comm: [sshd]
+`)
+	for _, tc := range []struct {
+		comm    string
+		cmdline []string
+		want    string
+	}{
+		// not_comm and cmdline both have to match
+		{"java", []string{"java", "-jar ", "app.jar"}, "java-java"},
+		{"kafka", []string{"java", "-jar ", "kafka.jar"}, "other"},
+		{"java", []string{"java", "-cp", "app.jar"}, "other"},
+		{"sshd", []string{"sshd"}, ""},
+		// an empty comm can't be told apart from the excluded ones
+		{"", []string{"java", "-jar ", "app.jar"}, ""},
+	} {
+		nacl := NameAndCmdline{Name: tc.comm, Cmdline: tc.cmdline}
+		matched, name := cfg.MatchAndName(nacl)
+		if !matched {
+			name = ""
+		}
+		if name != tc.want {
+			t.Errorf("comm %q, cmdline %q: got %q, want %q", tc.comm, tc.cmdline, name, tc.want)
+		}
+	}
+}
+
+func TestTTY(t *testing.T) {
+	for _, tc := range []struct {
+		ttys string
+		tty  int
+		want bool
+	}{
+		// daemons have no controlling terminal
+		{"[none]", 0, true},
+		{"[none]", 34816, false},
+		{"[any]", 0, false},
+		{"[any]", 34816, true},
+		{"[34816]", 34816, true},
+		{"[34816]", 34817, false},
+		{"[none, 34816]", 0, true},
+	} {
+		cfg := mustGetConfig(t, `
+process_names:
+  - name: "{{.Comm}}-{{.Matches.tty}}"
+    tty: `+tc.ttys+`
+`)
+		matched, name := cfg.MatchAndName(NameAndCmdline{Name: "sshd", TTY: tc.tty})
+		if matched != tc.want {
+			t.Errorf("tty %s, tty_nr %d: matched = %v, want %v", tc.ttys, tc.tty, matched, tc.want)
+		} else if want := fmt.Sprintf("sshd-%d", tc.tty); matched && name != want {
+			t.Errorf("tty %s, tty_nr %d: name = %q, want %q", tc.ttys, tc.tty, name, want)
+		}
+	}
+
+	if _, err := GetConfig(`
+process_names:
+  - tty: [console]
+`); err == nil {
+		t.Error("GetConfig() with tty console succeeded, want error")
+	}
+}
+
+func TestListeningPorts(t *testing.T) {
+	for _, tc := range []struct {
+		pid  int
+		want []int
+	}{
+		// sockets 1111 and 3333 listen in tcp and tcp6, 2222 is connected
+		// and 9999 listens for another process
+		{100, []int{443, 8080}},
+		{101, nil},
+		// no fds to read
+		{102, nil},
+	} {
+		nacl := NameAndCmdline{PID: tc.pid, procfsPath: "testdata/proc"}
+		if got := listeningPorts(nacl); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("pid %d: listeningPorts() = %v, want %v", tc.pid, got, tc.want)
+		}
+	}
+
+	cfg := mustGetConfig(t, `
+process_names:
+  - name: "listen-{{.Matches.ports}}-{{.Matches.port}}"
+    listening: true
+  - name: "client"
+    listening: false
+`)
+	for pid, want := range map[int]string{100: "listen-443,8080-443", 101: "client"} {
+		nacl := NameAndCmdline{Name: "app", PID: pid, procfsPath: "testdata/proc"}
+		if _, name := cfg.MatchAndName(nacl); name != want {
+			t.Errorf("pid %d: name = %q, want %q", pid, name, want)
+		}
+	}
+}
+
+func TestExeBase(t *testing.T) {
+	for path, want := range map[string]string{
+		"server":                "server",
+		"/usr/bin/server":       "server",
+		`C:\app\server.exe`:     "server.exe",
+		`C:/app\bin/server.exe`: "server.exe",
+		"/usr/bin/":             "bin",
+		"":                      "",
+	} {
+		if got := exeBase(path); got != want {
+			t.Errorf("exeBase(%q) = %q, want %q", path, got, want)
+		}
+	}
+
+	cfg := mustGetConfig(t, `
+process_names:
+  - name: "{{.ExeBase}}"
+    exe: [server.exe, 'C:\app\full.exe']
+`)
+	for _, tc := range []struct {
+		argv0 string
+		want  bool
+	}{
+		{`C:\app\server.exe`, true},
+		{`D:\other\server.exe`, true},
+		{`C:\app\full.exe`, true},
+		// a value with a path has to match whole
+		{`D:\other\full.exe`, false},
+		{`C:\app\client.exe`, false},
+	} {
+		nacl := NameAndCmdline{Name: "wine", Cmdline: []string{tc.argv0}}
+		matched, name := cfg.MatchAndName(nacl)
+		if matched != tc.want {
+			t.Errorf("argv[0] %q: matched = %v, want %v", tc.argv0, matched, tc.want)
+		} else if want := exeBase(tc.argv0); matched && name != want {
+			t.Errorf("argv[0] %q: name = %q, want %q", tc.argv0, name, want)
+		}
+	}
+}
+
+func TestTOMLConfig(t *testing.T) {
+	yamlCfg := mustGetConfig(t, `
+process_names:
+  - comm: [bash, zsh]
+  - name: "dispatcher-{{.Matches.argv1}}"
+    argv:
+      0: 'dispatcher$'
+      1: '^(worker|scheduler)$'
+  - name: "{{.ExeBase}}"
+    exe: [/usr/bin/python3]
+    cmdline: ['-m (?P<module>\S+)']
+    cmdline_mode: args
+    pid: ["100-200", "300"]
+    tty: [none]
+    namespace: {pid: false}
+    listening: true
+    min_age_seconds: 30
+    fd_usage_above: 0.5
+    sample_rate: 4
+    priority: 10
+    max_cmdline_len: 4096
+    account: "team"
+`)
+	tomlCfg, err := GetTOMLConfig(`
+[[process_names]]
+comm = ["bash", "zsh"]
+
+[[process_names]]
+name = "dispatcher-{{.Matches.argv1}}"
+[process_names.argv]
+0 = 'dispatcher$'
+1 = '^(worker|scheduler)$'
+
+[[process_names]]
+name = "{{.ExeBase}}"
+exe = ["/usr/bin/python3"]
+cmdline = ['-m (?P<module>\S+)']
+cmdline_mode = "args"
+pid = ["100-200", "300"]
+tty = ["none"]
+namespace = { pid = false }
+listening = true
+min_age_seconds = 30.0
+fd_usage_above = 0.5
+sample_rate = 4
+priority = 10
+max_cmdline_len = 4096
+account = "team"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := json.Marshal(yamlCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(tomlCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("TOML config:\n%s\ndiffers from YAML config:\n%s", got, want)
+	}
+}
+
+func TestReadConfigExpandEnv(t *testing.T) {
+	t.Setenv("PROC_EXPORTER_TEST_ENV", "prod")
+	cfgpath := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(cfgpath, []byte(`
+process_names:
+  - name: "{{.Comm}}-${PROC_EXPORTER_TEST_ENV}"
+    cmdline: ['^app$']
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nacl := NameAndCmdline{Name: "app", Cmdline: []string{"app"}}
+	for _, tc := range []struct {
+		read func(string) (*Config, error)
+		want string
+	}{
+		{ReadConfig, "app-${PROC_EXPORTER_TEST_ENV}"},
+		// the regex anchor is kept
+		{ReadConfigExpandEnv, "app-prod"},
+	} {
+		cfg, err := tc.read(cfgpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, name := cfg.MatchAndName(nacl); name != tc.want {
+			t.Errorf("name = %q, want %q", name, tc.want)
+		}
+	}
+}
+
+func TestDecodeCapabilities(t *testing.T) {
+	for _, tc := range []struct {
+		set  uint64
+		want []string
+	}{
+		{0, nil},
+		{0x200000, []string{"sys_admin"}},
+		// the default set of Docker containers
+		{0xa80425fb, []string{"chown", "dac_override", "fowner", "fsetid", "kill", "setgid", "setuid", "setpcap", "net_bind_service", "net_raw", "sys_chroot", "mknod", "audit_write", "setfcap"}},
+		// bits unknown to the table
+		{1<<40 | 1<<63, []string{"checkpoint_restore", "63"}},
+	} {
+		if got := decodeCapabilities(tc.set); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("decodeCapabilities(%#x) = %q, want %q", tc.set, got, tc.want)
+		}
+	}
+	// all of them for root on a 5.9+ kernel
+	if got := decodeCapabilities(0x1ffffffffff); len(got) != len(capabilityNames) || got[len(got)-1] != "checkpoint_restore" {
+		t.Errorf("decodeCapabilities(0x1ffffffffff) = %q, want all %d names", got, len(capabilityNames))
+	}
+
+	cfg := mustGetConfig(t, `
+process_names:
+  - name: "{{.Comm}}-{{.Matches.capabilities}}"
+    capability: [CAP_SYS_ADMIN, net_raw, setuid]
+`)
+	for pid, want := range map[int]string{
+		// CapEff of the Docker default set
+		100: "app-setuid,net_raw",
+		// no capabilities
+		101: "",
+		// no status file
+		102: "",
+	} {
+		nacl := NameAndCmdline{Name: "app", PID: pid, procfsPath: "testdata/proc"}
+		if _, name := cfg.MatchAndName(nacl); name != want {
+			t.Errorf("pid %d: name = %q, want %q", pid, name, want)
+		}
+	}
+
+	if _, err := GetConfig(`
+process_names:
+  - capability: [CAP_FLY]
+`); err == nil {
+		t.Error("GetConfig() with capability CAP_FLY succeeded, want error")
+	}
+}
+
+func TestFdUsage(t *testing.T) {
+	cfg := mustGetConfig(t, `
+process_names:
+  - name: "{{.Comm}}-{{.Matches.fd_usage}}"
+    fd_usage_above: 0.004
+`)
+	for pid, want := range map[int]string{
+		// 5 fds of 1024
+		100: "app-0.00",
+		// 2 fds of 4096
+		101: "",
+		// no limits file
+		103: "",
+	} {
+		nacl := NameAndCmdline{Name: "app", PID: pid, procfsPath: "testdata/proc"}
+		if _, name := cfg.MatchAndName(nacl); name != want {
+			t.Errorf("pid %d: name = %q, want %q", pid, name, want)
+		}
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	cfg := mustGetConfig(t, `
+process_names:
+  - name: "gpu-{{.Matches.open_file}}"
+    open_file: ['^/dev/nvidia[0-9]+$']
+  - name: "socket-{{.Matches.open_file}}"
+    open_file: ['^socket:']
+`)
+	for pid, want := range map[int]string{
+		// the lowest of /dev/nvidia0 and /dev/nvidia1, not /dev/nvidiactl
+		103: "gpu-/dev/nvidia0",
+		100: "socket-socket:[1111]",
+		// no fds to read
+		102: "",
+	} {
+		nacl := NameAndCmdline{Name: "app", PID: pid, procfsPath: "testdata/proc"}
+		if _, name := cfg.MatchAndName(nacl); name != want {
+			t.Errorf("pid %d: name = %q, want %q", pid, name, want)
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	cfg := mustGetConfig(t, `
+process_names:
+  - name: catch-all
+    cmdline: ['.+']
+  - name: "java-first"
+    comm: [java]
+  - name: "java-second"
+    comm: [java]
+  - name: "kafka"
+    priority: 10
+    cmdline: ['kafka\.Kafka']
+  - name: "negative"
+    priority: -1
+    comm: [sleep]
+`)
+	for _, tc := range []struct {
+		comm    string
+		cmdline []string
+		want    string
+	}{
+		// a later entry of higher priority wins
+		{"java", []string{"java", "kafka.Kafka"}, "kafka"},
+		// equal priorities keep config order
+		{"java", []string{"java", "-jar", "app.jar"}, "catch-all"},
+		{"java", nil, "java-first"},
+		{"sleep", []string{"sleep", "1"}, "catch-all"},
+		// only the entry of lower priority than the others matches
+		{"sleep", nil, "negative"},
+	} {
+		nacl := NameAndCmdline{Name: tc.comm, Cmdline: tc.cmdline}
+		if _, name := cfg.MatchAndName(nacl); name != tc.want {
+			t.Errorf("comm %q, cmdline %q: name = %q, want %q", tc.comm, tc.cmdline, name, tc.want)
+		}
+	}
+
+	var names []string
+	for _, m := range cfg.MatchNamers {
+		names = append(names, m.(*matchNamer).template.Root.String())
+	}
+	want := []string{"kafka", "catch-all", "java-first", "java-second", "negative"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("entries ordered %q, want %q", names, want)
+	}
+}
+
+func TestAgeMatcher(t *testing.T) {
+	m := &ageMatcher{minAge: 60, now: func() time.Time { return time.Unix(1500001000, 0) }}
+	for _, tc := range []struct {
+		startTime float64
+		want      bool
+	}{
+		{1500000000, true},
+		{1500000940, true},
+		{1500000940.5, false},
+		{1500001000, false},
+		// started after now, e.g. after the clock stepped back
+		{1500002000, false},
+		// unknown boot time
+		{0, false},
+	} {
+		if got, _ := m.Match(NameAndCmdline{StartTime: tc.startTime}); got != tc.want {
+			t.Errorf("Match(StartTime %v) = %v, want %v", tc.startTime, got, tc.want)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	cfg := mustGetConfig(t, `
+process_names:
+  - comm: [bash]
+    sample_rate: 2
+  - name: "port-{{.Matches.Port}}"
+    cmdline: ['--port=(?P<Port>\d+)']
+  - name: "{{.Comm}}"
+    comm: [bash, app]
+`)
+	for _, tc := range []struct {
+		nacl    NameAndCmdline
+		want    Explanation
+		matched bool
+		name    string
+	}{
+		{
+			NameAndCmdline{PID: 1, Name: "bash", Cmdline: []string{"bash"}},
+			Explanation{Matched: true, Index: 0, Name: "bash", Matches: map[string]string{}},
+			true, "bash",
+		},
+		// ignored by the sampled entry rather than left to the last one
+		{
+			NameAndCmdline{PID: 2, Name: "bash", Cmdline: []string{"bash"}},
+			Explanation{Index: 0},
+			false, "",
+		},
+		// the whole match is captured under the empty name
+		{
+			NameAndCmdline{PID: 3, Name: "app", Cmdline: []string{"app", "--port=8080"}},
+			Explanation{Matched: true, Index: 1, Name: "port-8080", Matches: map[string]string{"": "--port=8080", "Port": "8080"}},
+			true, "port-8080",
+		},
+		{
+			NameAndCmdline{PID: 4, Name: "app", Cmdline: []string{"app"}},
+			Explanation{Matched: true, Index: 2, Name: "app", Matches: map[string]string{}},
+			true, "app",
+		},
+		{
+			NameAndCmdline{PID: 5, Name: "sshd", Cmdline: []string{"sshd"}},
+			Explanation{Index: -1},
+			false, "",
+		},
+	} {
+		if got := cfg.Explain(tc.nacl); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Explain(%v) = %+v, want %+v", tc.nacl, got, tc.want)
+		}
+		if matched, name := cfg.MatchAndName(tc.nacl); matched != tc.matched || name != tc.name {
+			t.Errorf("MatchAndName(%v) = %v, %q, want %v, %q", tc.nacl, matched, name, tc.matched, tc.name)
+		}
+	}
+}
+
+func TestChrooted(t *testing.T) {
+	cfg := mustGetConfig(t, `
+process_names:
+  - name: "jailed:{{.Matches.root}}"
+    chrooted: true
+  - name: host
+    chrooted: false
+`)
+	for pid, want := range map[int]string{
+		// the fixture lacks the root of PID 1, so that of the test is
+		// compared
+		100: "host",
+		101: "jailed:../../jail",
+		// no root to read
+		103: "",
+	} {
+		nacl := NameAndCmdline{Name: "app", PID: pid, procfsPath: "testdata/proc"}
+		if _, name := cfg.MatchAndName(nacl); name != want {
+			t.Errorf("pid %d: name = %q, want %q", pid, name, want)
+		}
+	}
+}
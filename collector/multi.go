@@ -0,0 +1,154 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// MultiProcCollector reads processes from several procfs mounts, like those
+// of the containers of a host, with a ProcCollector per mount. Its series
+// carry the path of the mount as the procfs label.
+type MultiProcCollector struct {
+	patterns []string
+	opts     Options
+	proto    *ProcCollector
+
+	mtx        sync.Mutex
+	matchnamer MatchNamer
+	collectors map[string]*ProcCollector
+	errors     int
+
+	procfsErrors *prometheus.Desc
+}
+
+// NewMultiProcCollector returns a collector reading from the paths matching
+// patterns, as with filepath.Glob. The patterns are expanded on every
+// collection, so that mounts may come and go. Matched paths that can't be
+// read are skipped and counted in proc_procfs_errors_total.
+func NewMultiProcCollector(patterns []string, matchnamer MatchNamer, opts Options) *MultiProcCollector {
+	protoOpts := opts
+	protoOpts.ConstLabels = procfsLabels(opts.ConstLabels, "")
+
+	return &MultiProcCollector{
+		patterns:   patterns,
+		opts:       opts,
+		proto:      NewProcCollector("", matchnamer, protoOpts),
+		matchnamer: matchnamer,
+		collectors: make(map[string]*ProcCollector),
+		procfsErrors: prometheus.NewDesc(
+			"proc_procfs_errors_total",
+			"Number of procfs paths matched but skipped as they could not be read.",
+			nil,
+			opts.ConstLabels,
+		),
+	}
+}
+
+// procfsLabels returns labels along with the procfs label set to path.
+func procfsLabels(labels map[string]string, path string) map[string]string {
+	l := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l["procfs"] = path
+	return l
+}
+
+// Describe implements prometheus.Collector.
+func (c *MultiProcCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.proto.Describe(ch)
+	ch <- c.procfsErrors
+}
+
+// Collect implements prometheus.Collector.
+func (c *MultiProcCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(context.Background(), ch, "")
+}
+
+// SetMatchNamer replaces the matchnamer of the collectors of all paths.
+func (c *MultiProcCollector) SetMatchNamer(matchnamer MatchNamer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.matchnamer = matchnamer
+	for _, pc := range c.collectors {
+		pc.SetMatchNamer(matchnamer)
+	}
+}
+
+// ForGroup is like ProcCollector.ForGroup.
+func (c *MultiProcCollector) ForGroup(group string) prometheus.Collector {
+	return c.ForContext(context.Background(), group)
+}
+
+// ForContext is like ProcCollector.ForContext.
+func (c *MultiProcCollector) ForContext(ctx context.Context, group string) prometheus.Collector {
+	return multiGroupCollector{c, ctx, group}
+}
+
+type multiGroupCollector struct {
+	*MultiProcCollector
+	ctx   context.Context
+	group string
+}
+
+func (c multiGroupCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(c.ctx, ch, c.group)
+}
+
+// collect emits the metrics of the collectors of all paths currently
+// matching the patterns.
+func (c *MultiProcCollector) collect(ctx context.Context, ch chan<- prometheus.Metric, group string) {
+	for _, pc := range c.expand() {
+		pc.ForContext(ctx, group).Collect(ch)
+	}
+
+	c.mtx.Lock()
+	errors := c.errors
+	c.mtx.Unlock()
+	ch <- prometheus.MustNewConstMetric(c.procfsErrors, prometheus.CounterValue, float64(errors))
+}
+
+// expand returns the collectors of the paths matching the patterns, creating
+// those of new paths and dropping those of paths gone since the last call.
+func (c *MultiProcCollector) expand() []*ProcCollector {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var pcs []*ProcCollector
+	seen := make(map[string]bool)
+	for _, pattern := range c.patterns {
+		// Glob only fails on malformed patterns, which match nothing.
+		paths, _ := filepath.Glob(pattern)
+		for _, path := range paths {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			if _, err := os.Stat(filepath.Join(path, "stat")); err != nil {
+				log.Debugf("Skipping procfs path %s: %v", path, err)
+				c.errors += 1
+				continue
+			}
+
+			pc, ok := c.collectors[path]
+			if !ok {
+				opts := c.opts
+				opts.ConstLabels = procfsLabels(c.opts.ConstLabels, path)
+				pc = NewProcCollector(path, c.matchnamer, opts)
+				c.collectors[path] = pc
+			}
+			pcs = append(pcs, pc)
+		}
+	}
+	for path := range c.collectors {
+		if !seen[path] {
+			delete(c.collectors, path)
+		}
+	}
+	return pcs
+}
@@ -1,43 +1,337 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
 
 	"github.com/catawiki/proc_exporter/collector"
 )
 
+// configWatchDelay is how long -config.watch waits for further changes of
+// the config file before reloading it.
+const configWatchDelay = time.Second
+
 func main() {
 	var (
-		procfsPath    = flag.String("procfs", "/proc", "path to read proc data from")
-		configPath    = flag.String("config.path", "", "path to YAML config file")
+		procfsPath    = flag.String("procfs", "/proc", "path to read proc data from. Comma-separated paths and globs, e.g. /host/containers/*/proc, read several and label series with their procfs path.")
+		cgroupfsPath  = flag.String("cgroupfs", "/sys/fs/cgroup", "path to read cgroup data from, for -collect.cgroup-memory-limit.")
+		configPath    = flag.String("config.path", "", "path to YAML or TOML config file")
+		matchPolicy   = flag.String("config.match-policy", "first", "Which matching config entry names a process. One of: [first, most-specific]")
+		watchConfig   = flag.Bool("config.watch", false, "Reload the config file when it changes.")
+		expandEnv     = flag.Bool("config.expand-env", false, "Replace $VAR and ${VAR} in the config file with the values of environment variables.")
+		legacyErrors  = flag.Bool("compat.scrape-errors", false, "Also expose proc_scrape_errors, the former name of proc_scrape_errors_total. Will be removed in the next release.")
+		ambiguous     = flag.Bool("config.count-ambiguous", false, "Count processes matching more than one config entry. Evaluates all entries for every process.")
+		dryRun        = flag.Bool("dry-run", false, "Print the group each process is assigned to and exit.")
+		once          = flag.Bool("once", false, "Print the metrics of a single collection in the text format and exit.")
+		memoryPercent = flag.Bool("collect.memory-percent", false, "Expose resident memory as a percentage of host memory.")
+		cpuUtil       = flag.Bool("collect.cpu-utilization", false, "Expose CPU utilization since the previous scrape. Keeps state between scrapes.")
+		memSegments   = flag.Bool("collect.memory-segments", false, "Expose the stack, data, text and lib memory types. Reads the status file of every process.")
+		allowedCPUs   = flag.Bool("collect.allowed-cpus", false, "Expose the number of CPUs each group may run on. Reads the status file of every process.")
+		oomScore      = flag.Bool("collect.oom-score", false, "Expose the OOM killer scores and adjustments. Reads two files of every process.")
+		ioSyscalls    = flag.Bool("collect.io-syscalls", false, "Expose the number of read and write syscalls. Reads the io file of every process.")
+		memQuantiles  = flag.String("collect.memory-quantiles", "", "Comma-separated quantiles of the per-process resident memory summary, e.g. 0.5,0.95,0.99. Disabled when empty.")
+		shm           = flag.Bool("collect.shm", false, "Expose the number of shared memory segments. Parses the memory maps of every process.")
+		mappedFiles   = flag.Bool("collect.mapped-files", false, "Expose the number and size of memory-mapped files. Parses the memory maps of every process.")
+		cgroupMemory  = flag.Bool("collect.cgroup-memory-limit", false, "Expose the memory limits of the cgroups of each group.")
+		cwdFs         = flag.Bool("collect.cwd-fs", false, "Expose the used space of the filesystems holding the working directories of each group. Runs statfs for every process.")
+		cmdlineInfo   = flag.Bool("collect.cmdline-info", false, "Expose the command line of the oldest process of each group as a label. Only for a few groups with distinct command lines, see the README.")
+		cmdlineMaxLen = flag.Int("collect.cmdline-info.max-length", 200, "Truncate the command line label to this many characters. Use 0 to disable.")
+		membersByExe  = flag.Bool("collect.members-by-exe", false, "Expose the number of processes of each group per executable.")
+		membersTopN   = flag.Int("collect.members-by-exe.top", 10, "Number of most common executables per group to expose, the others are summed up as \"other\".")
+		cloneVM       = flag.Bool("collect.clone-shared-vm", false, "Expose the number of processes of each group sharing their virtual memory with another one. Compares every group's processes with kcmp(2), which requires root.")
+		wchan         = flag.Bool("collect.wchan", false, "Expose the number of processes sleeping in each kernel function.")
+		threadBuckets = flag.String("collect.threads-buckets", "", "Comma-separated bucket bounds of the threads per process histogram, e.g. 1,4,16,64,256,1024. Disabled when empty.")
+		nativeHist    = flag.Bool("histogram.native", false, "Also expose histograms as native histograms, which Prometheus scrapes in the protobuf format. The text formats keep the classic buckets of -collect.threads-buckets. Enables the threads per process histogram.")
+		threads       = flag.Bool("collect.threads", true, "Expose thread counts.")
+		threadStates  = flag.Bool("collect.thread-states", false, "Expose the number of threads in each state. Reads the stat file of every thread. Requires -collect.threads.")
+		cpuByRole     = flag.Bool("collect.cpu-by-thread-role", false, "Split CPU time into that of the main thread and of the other threads of each process. Reads the stat file of every main thread. Requires -collect.threads.")
+		startTime     = flag.Bool("collect.start-time", true, "Expose process start times and ages.")
+		fds           = flag.Bool("collect.fds", true, "Expose open file descriptors.")
+		fdLimit       = flag.Bool("collect.fd-limit", false, "Expose the lowest open file limit of each group. Reads the limits file of every process. Requires -collect.fds.")
+		fdTypes       = flag.Bool("collect.fd-types", false, "Expose open file descriptors by type. Reads the link of every fd. Requires -collect.fds.")
+		aggregation   = flag.String("collect.aggregation", "", "Comma-separated family=aggregation pairs overriding how the values of a group's processes are combined, e.g. memory_bytes=max,fd_limit=avg. Aggregations: [sum, max, min, avg]")
+		sanitize      = flag.Bool("name.sanitize", false, "Replace the characters of -name.sanitize-chars in group names with underscores.")
+		sanitizeChars = flag.String("name.sanitize-chars", `,="'`, "Characters to replace in group names when -name.sanitize is set.")
+		nameMaxLen    = flag.Int("name.max-length", 128, "Truncate longer group names to this many characters, ending in a hash of the full name. Use 0 to disable.")
 		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		listenAddress = flag.String("web.listen-address", ":9256", "Address to listen on for web interface and telemetry.")
+		listenAddress = flag.String("web.listen-address", ":9256", "Address to listen on for web interface and telemetry. Use unix:<path> to listen on a unix socket instead.")
+		socketMode    = flag.String("web.socket-mode", "0660", "Permissions of the unix socket of -web.listen-address, in octal.")
+		tlsCertFile   = flag.String("web.tls-cert-file", "", "PEM certificate file to serve HTTPS with. Requires -web.tls-key-file. Plain HTTP when empty.")
+		tlsKeyFile    = flag.String("web.tls-key-file", "", "PEM private key file of -web.tls-cert-file.")
+		clientCAFile  = flag.String("web.client-ca-file", "", "PEM file of the CAs to verify client certificates with. Connections without a valid client certificate fail the TLS handshake. Requires -web.tls-cert-file.")
+		clientNames   = flag.String("web.client-allowed-names", "", "Comma-separated names, one of which the common name or a DNS name of the client certificate must be. Any verified client is accepted when empty. Requires -web.client-ca-file.")
+		maxRequests   = flag.Int("web.max-requests", 3, "Maximum number of parallel scrape requests. Use 0 to disable.")
+		timeoutOffset = flag.Duration("scrape.timeout-offset", 500*time.Millisecond, "Subtract this from the X-Prometheus-Scrape-Timeout-Seconds header of a scrape, to return before Prometheus gives up.")
+		scrapeTimeout = flag.Duration("scrape.timeout", 0, "Stop reading processes after this long and return the groups read so far. No limit when 0.")
+		noCompression = flag.Bool("web.disable-compression", false, "Never gzip responses, even if the client accepts it.")
+		gzipAlways    = flag.Bool("web.force-compression", false, "Always gzip responses, even if the client doesn't send Accept-Encoding: gzip.")
+		noOpenMetrics = flag.Bool("web.disable-openmetrics", false, "Never serve the OpenMetrics format, even if the client prefers it.")
+		pushGateway   = flag.String("push.gateway", "", "URL of a Pushgateway to push metrics to, in addition to serving them. Disabled when empty.")
+		pushJob       = flag.String("push.job", "proc_exporter", "Job name to push metrics under.")
+		pushGrouping  = flag.String("push.grouping", "", "Comma-separated name=value grouping labels to push metrics under.")
+		pushInterval  = flag.Duration("push.interval", 15*time.Second, "Interval between pushes.")
+		accessLog     = flag.Bool("web.access-log", false, "Log every request to the metrics endpoint.")
+		logLevel      = flag.String("log.level", "info", "Only log messages with the given severity or above. One of: [debug, info, warn, error, fatal]")
+		logFormat     = flag.String("log.format", "text", "Format of log messages. One of: [text, json]")
 	)
+	var accountAllow, accountDeny stringList
+	flag.Var(&accountAllow, "account.allow", "Only collect processes owned by this user. Can be repeated.")
+	flag.Var(&accountDeny, "account.deny", "Don't collect processes owned by this user, even if allowed. Can be repeated.")
 	flag.Parse()
 
+	if err := log.Base().SetLevel(*logLevel); err != nil {
+		log.Fatalf("Error setting log level %q: %v", *logLevel, err)
+	}
+	collector.LogMismatches = *logLevel == "debug"
+	switch *logFormat {
+	case "text":
+	case "json":
+		if err := log.Base().SetFormat("logger:stderr?json=true"); err != nil {
+			log.Fatalf("Error setting log format: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown log format %q", *logFormat)
+	}
+
 	log.Infoln("Starting proc_exporter", version.Info())
 	log.Infoln("Build context", version.BuildContext())
 
+	buckets, err := parseFloats(*threadBuckets)
+	if err != nil {
+		log.Fatalf("Error parsing threads buckets %q: %v", *threadBuckets, err)
+	}
+	quantiles, err := parseFloats(*memQuantiles)
+	if err != nil {
+		log.Fatalf("Error parsing memory quantiles %q: %v", *memQuantiles, err)
+	}
+	aggregations, err := parseAggregations(*aggregation)
+	if err != nil {
+		log.Fatalf("Error parsing aggregations %q: %v", *aggregation, err)
+	}
+
+	procfsPaths, err := parseProcfsPaths(*procfsPath)
+	if err != nil {
+		log.Fatalf("Error parsing procfs paths %q: %v", *procfsPath, err)
+	}
+	multiProcfs := len(procfsPaths) > 1 || strings.ContainsAny(procfsPaths[0], `*?[`)
+	if !multiProcfs {
+		// Not fatal, the mount may show up later, which
+		// proc_procfs_available tells.
+		if err := collector.CheckProcfs(procfsPaths[0]); err != nil {
+			log.Warnf("Processes can't be read from %s, metrics will be empty until it is fixed: %v", procfsPaths[0], err)
+		}
+	}
+
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		log.Fatalf("Error parsing socket mode %q: %v", *socketMode, err)
+	}
+	var allowedNames []string
+	if *clientNames != "" {
+		allowedNames = strings.Split(*clientNames, ",")
+	}
+	tlsCfg, err := tlsConfig(*tlsCertFile, *tlsKeyFile, *clientCAFile, allowedNames)
+	if err != nil {
+		log.Fatalf("Error setting up TLS: %v", err)
+	}
+
+	var membersTop int
+	if *membersByExe {
+		if *membersTopN < 1 {
+			log.Fatalf("Invalid -collect.members-by-exe.top %d: must be positive", *membersTopN)
+		}
+		membersTop = *membersTopN
+	}
+	if *noCompression && *gzipAlways {
+		log.Fatalf("-web.disable-compression and -web.force-compression are mutually exclusive")
+	}
+	if *nameMaxLen != 0 && *nameMaxLen <= 9 {
+		log.Fatalf("Invalid -name.max-length %d: must leave room for the 9 characters of the hash", *nameMaxLen)
+	}
+
 	var matchnamer collector.MatchNamer
+	var cfgMetrics *configMetrics
+	var cfgHandler configHandler
+	// watchPaths are the files whose changes reload the config.
+	watchPaths := []string{*configPath}
+	loader := &configLoader{
+		path:          *configPath,
+		expandEnv:     *expandEnv,
+		matchPolicy:   *matchPolicy,
+		sanitize:      *sanitize,
+		sanitizeChars: *sanitizeChars,
+		nameMaxLen:    *nameMaxLen,
+	}
 
 	if *configPath != "" {
-		cfg, err := collector.ReadConfig(*configPath)
+		var cfg *collector.Config
+		var sum string
+		matchnamer, cfg, sum, err = loader.load()
 		if err != nil {
 			log.Fatalf("Error reading config file %q: %v", *configPath, err)
 		}
-		log.Infoln("Reading metrics from %s based on %q", *procfsPath, *configPath)
-		matchnamer = cfg.MatchNamers
+		cfgMetrics = newConfigMetrics()
+		cfgMetrics.update(cfg, sum)
+		cfgHandler.set(cfg)
+		watchPaths = append(watchPaths, cfg.ExeTables...)
+		log.Infof("Reading metrics from %s based on %q", *procfsPath, *configPath)
 	}
 
-	prometheus.MustRegister(collector.NewProcCollector(*procfsPath, matchnamer))
+	if *dryRun {
+		if !multiProcfs {
+			if err := printMatches(os.Stdout, procfsPaths[0], matchnamer); err != nil {
+				log.Fatalf("Error matching processes: %v", err)
+			}
+			return
+		}
+		for _, pattern := range procfsPaths {
+			paths, _ := filepath.Glob(pattern)
+			for _, path := range paths {
+				fmt.Printf("# procfs %s\n", path)
+				if err := printMatches(os.Stdout, path, matchnamer); err != nil {
+					log.Errorf("Error matching processes of %s: %v", path, err)
+				}
+			}
+		}
+		return
+	}
 
-	http.Handle(*metricsPath, promhttp.Handler())
+	if cfgMetrics != nil {
+		prometheus.MustRegister(cfgMetrics.rules, cfgMetrics.hash)
+	}
+	opts := collector.Options{
+		MemoryPercent:        *memoryPercent,
+		ThreadsBuckets:       buckets,
+		NativeHistograms:     *nativeHist,
+		CPUUtilization:       *cpuUtil,
+		MemorySegments:       *memSegments,
+		AllowedCPUs:          *allowedCPUs,
+		OomScore:             *oomScore,
+		IOSyscalls:           *ioSyscalls,
+		MemoryQuantiles:      quantiles,
+		CountAmbiguous:       *ambiguous,
+		SharedMemory:         *shm,
+		MappedFiles:          *mappedFiles,
+		Wchan:                *wchan,
+		ThreadStates:         *threadStates,
+		CPUByThreadRole:      *cpuByRole,
+		FdTypes:              *fdTypes,
+		CwdFilesystem:        *cwdFs,
+		CgroupMemoryLimit:    *cgroupMemory,
+		CgroupfsPath:         *cgroupfsPath,
+		CmdlineInfo:          *cmdlineInfo,
+		CmdlineInfoMaxLength: *cmdlineMaxLen,
+		MembersByExe:         membersTop,
+		CloneSharedVM:        *cloneVM,
+		NoThreads:            !*threads,
+		NoStartTime:          !*startTime,
+		NoFds:                !*fds,
+		FdLimit:              *fdLimit,
+		AccountAllow:         accountAllow,
+		AccountDeny:          accountDeny,
+		Aggregations:         aggregations,
+		ScrapeTimeout:        *scrapeTimeout,
+		LegacyScrapeErrors:   *legacyErrors,
+	}
+	var procCollector procCollector
+	if multiProcfs {
+		procCollector = collector.NewMultiProcCollector(procfsPaths, matchnamer, opts)
+	} else {
+		procCollector = collector.NewProcCollector(procfsPaths[0], matchnamer, opts)
+	}
+	// procCollector is registered per scrape to stop at the scrape's
+	// deadline, see scrapeHandler. Only pushes and -once use this registry.
+	procRegistry := prometheus.NewRegistry()
+	procRegistry.MustRegister(procCollector)
+
+	if *once {
+		if err := printMetrics(os.Stdout, gatherers{prometheus.DefaultGatherer, procRegistry}); err != nil {
+			log.Fatalf("Error collecting metrics: %v", err)
+		}
+		return
+	}
+
+	if *watchConfig && *configPath != "" {
+		var reloadMtx sync.Mutex
+		reload := func() {
+			reloadMtx.Lock()
+			defer reloadMtx.Unlock()
+
+			matchnamer, cfg, sum, err := loader.load()
+			if err != nil {
+				log.Errorf("Error reloading config file %q, keeping the previous config: %v", *configPath, err)
+				return
+			}
+			if sum == cfgMetrics.sum {
+				return
+			}
+			procCollector.SetMatchNamer(matchnamer)
+			cfgMetrics.update(cfg, sum)
+			cfgHandler.set(cfg)
+			log.Infof("Reloaded config file %q", *configPath)
+		}
+		// Exe tables added later are only noticed along with the config
+		// file, unless they are in a directory watched already.
+		watched := make(map[string]bool)
+		for _, path := range watchPaths {
+			if watched[filepath.Dir(path)] {
+				continue
+			}
+			watched[filepath.Dir(path)] = true
+			if err := watchFile(path, reload); err != nil {
+				log.Fatalf("Error watching config file %q: %v", path, err)
+			}
+		}
+	}
+
+	// Responses are gzipped if the client accepts it, unless disabled or
+	// forced.
+	handlerOpts := handlerOpts{
+		disableCompression: *noCompression,
+		forceCompression:   *gzipAlways,
+		disableOpenMetrics: *noOpenMetrics,
+	}
+	var metricsHandler http.Handler = instrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		limitRequests(*maxRequests, scrapeHandler(procCollector, handlerOpts, *timeoutOffset)),
+	)
+	if *accessLog {
+		metricsHandler = logRequests(metricsHandler)
+	}
+
+	http.Handle(*metricsPath, metricsHandler)
+	if *configPath != "" {
+		http.Handle("/-/config", &cfgHandler)
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>Proc Exporter</title></head>
@@ -48,6 +342,708 @@ func main() {
 			</html>`))
 	})
 
+	if *pushGateway != "" {
+		var grouping []string
+		if *pushGrouping != "" {
+			grouping = strings.Split(*pushGrouping, ",")
+		}
+		pusher, err := newPusher(*pushGateway, *pushJob, grouping, gatherers{prometheus.DefaultGatherer, procRegistry})
+		if err != nil {
+			log.Fatalf("Error setting up pushes: %v", err)
+		}
+		pusher.client.Timeout = *pushInterval
+		log.Infoln("Pushing to", *pushGateway, "every", *pushInterval)
+		go pushLoop(pusher, *pushInterval)
+	}
+
+	l, err := listen(*listenAddress, os.FileMode(mode))
+	if err != nil {
+		log.Fatalf("Error listening on %s: %v", *listenAddress, err)
+	}
+	if tlsCfg != nil {
+		l = tls.NewListener(l, tlsCfg)
+	}
 	log.Infoln("Listening on", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	log.Fatal(http.Serve(l, nil))
+}
+
+// tlsConfig returns the TLS config serving certFile, or nil for plain HTTP if
+// certFile is empty. With caFile, clients must present a certificate signed
+// by one of its CAs, and, with allowedNames, carrying one of them as common
+// name or DNS name. Other clients fail the handshake, before any request.
+func tlsConfig(certFile, keyFile, caFile string, allowedNames []string) (*tls.Config, error) {
+	if certFile == "" {
+		if keyFile != "" || caFile != "" {
+			return nil, fmt.Errorf("-web.tls-key-file and -web.client-ca-file require -web.tls-cert-file")
+		}
+		return nil, nil
+	}
+	if caFile == "" && len(allowedNames) > 0 {
+		return nil, fmt.Errorf("-web.client-allowed-names requires -web.client-ca-file")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(allowedNames) > 0 {
+		// called after the chain was verified against ClientCAs
+		cfg.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			leaf := chains[0][0]
+			for _, name := range allowedNames {
+				if leaf.Subject.CommonName == name {
+					return nil
+				}
+				for _, dnsName := range leaf.DNSNames {
+					if dnsName == name {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("client certificate for %q is not allowed", leaf.Subject.CommonName)
+		}
+	}
+	return cfg, nil
+}
+
+// listen listens on a TCP address, or on a unix socket for addresses like
+// unix:/run/proc_exporter.sock. The socket file gets the permissions mode. A
+// socket file left behind by a previous run is removed, other files are
+// not.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, "unix:")
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// configLoader reads the config file and builds the MatchNamer from it, as
+// selected by the flags.
+type configLoader struct {
+	path          string
+	expandEnv     bool
+	matchPolicy   string
+	sanitize      bool
+	sanitizeChars string
+	nameMaxLen    int
+}
+
+// load returns the MatchNamer, the config and the SHA256 of the config file
+// followed by the exe tables it refers to.
+func (l *configLoader) load() (collector.MatchNamer, *collector.Config, string, error) {
+	read := collector.ReadConfig
+	if l.expandEnv {
+		read = collector.ReadConfigExpandEnv
+	}
+	cfg, err := read(l.path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	h := sha256.New()
+	for _, path := range append([]string{l.path}, cfg.ExeTables...) {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		h.Write(content)
+	}
+	sum := h.Sum(nil)
+
+	var matchnamer collector.MatchNamer
+	switch l.matchPolicy {
+	case "first":
+		matchnamer = cfg.MatchNamers
+	case "most-specific":
+		matchnamer = collector.MostSpecificMatcher(cfg.MatchNamers)
+	default:
+		return nil, nil, "", fmt.Errorf("unknown match policy %q", l.matchPolicy)
+	}
+	if l.sanitize {
+		matchnamer = collector.NameSanitizer{MatchNamer: matchnamer, Chars: l.sanitizeChars}
+	}
+	if l.nameMaxLen > 0 {
+		matchnamer = collector.NameTruncator{MatchNamer: matchnamer, MaxLength: l.nameMaxLen}
+	}
+	return matchnamer, cfg, hex.EncodeToString(sum), nil
+}
+
+// configMetrics describe the loaded config: the number of entries, and a
+// constant 1 labelled with the SHA256 of the config file, to spot hosts
+// running a stale config.
+type configMetrics struct {
+	rules prometheus.Gauge
+	hash  *prometheus.GaugeVec
+	// sum is the SHA256 of the loaded config file and its exe tables.
+	sum string
+}
+
+func newConfigMetrics() *configMetrics {
+	return &configMetrics{
+		rules: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "proc_exporter_config_rules",
+			Help: "Number of process_names entries in the config file.",
+		}),
+		hash: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proc_exporter_config_hash",
+			Help: "Constant 1, labelled with the SHA256 of the config file and its exe tables.",
+		}, []string{"sha256"}),
+	}
+}
+
+// update sets the metrics to describe cfg, read from a file with the SHA256
+// sum.
+func (m *configMetrics) update(cfg *collector.Config, sum string) {
+	m.rules.Set(float64(len(cfg.MatchNamers)))
+	m.hash.Reset()
+	m.hash.WithLabelValues(sum).Set(1)
+	m.sum = sum
+}
+
+// watchFile calls fn after the named file changed. The directory of the
+// file is watched rather than the file itself, so that replacing the file by
+// renaming another one over it, as editors and deploy tools do, is noticed
+// as well. Events are debounced, as a single change often causes several.
+func watchFile(path string, fn func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event := <-watcher.Events:
+				// Other files in the directory are not filtered out:
+				// symlinked configs, as mounted in Kubernetes, change
+				// through the link target. fn ignores unchanged content.
+				log.Debugf("Config directory event: %v", event)
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(configWatchDelay, fn)
+			case err := <-watcher.Errors:
+				log.Errorf("Error watching config file %q: %v", path, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// pusher pushes the metrics of a gatherer to a Pushgateway, replacing those
+// pushed before under the same job and grouping labels, as the push package
+// of client_golang does, which isn't vendored.
+type pusher struct {
+	url      string
+	gatherer prometheus.Gatherer
+	client   *http.Client
+}
+
+// newPusher returns a pusher to the Pushgateway at gateway, under job and
+// the grouping labels, given as name=value pairs. The scheme of gateway
+// defaults to http.
+func newPusher(gateway, job string, grouping []string, g prometheus.Gatherer) (*pusher, error) {
+	if !strings.Contains(gateway, "://") {
+		gateway = "http://" + gateway
+	}
+	if job == "" || strings.Contains(job, "/") {
+		return nil, fmt.Errorf("invalid job name %q", job)
+	}
+	u := strings.TrimSuffix(gateway, "/") + "/metrics/job/" + url.QueryEscape(job)
+	for _, kv := range grouping {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid grouping label %q: expected name=value", kv)
+		}
+		if !model.LegacyValidation.IsValidLabelName(parts[0]) || parts[0] == "job" {
+			return nil, fmt.Errorf("invalid grouping label name %q", parts[0])
+		}
+		// the Pushgateway would take slashes for path separators
+		if strings.Contains(parts[1], "/") {
+			return nil, fmt.Errorf("grouping label value %q contains '/'", parts[1])
+		}
+		u += "/" + parts[0] + "/" + url.QueryEscape(parts[1])
+	}
+	return &pusher{url: u, gatherer: g, client: &http.Client{}}, nil
+}
+
+// push gathers the metrics and PUTs them to the Pushgateway in the
+// delimited protobuf format.
+func (p *pusher) push() error {
+	mfs, err := p.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPut, p.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s from %s: %s", resp.Status, p.url, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// pushLoop pushes metrics every interval. After failed pushes the interval
+// is doubled, up to ten times the configured one.
+func pushLoop(pusher *pusher, interval time.Duration) {
+	wait := interval
+	for {
+		if err := pusher.push(); err != nil {
+			wait *= 2
+			if wait > 10*interval {
+				wait = 10 * interval
+			}
+			log.Errorf("Error pushing metrics, retrying in %v: %v", wait, err)
+		} else {
+			wait = interval
+		}
+		time.Sleep(wait)
+	}
+}
+
+// configHandler serves the loaded config as JSON, after parsing and ordering
+// by priority, to check which entries are in effect.
+type configHandler struct {
+	mtx sync.RWMutex
+	cfg *collector.Config
+}
+
+func (h *configHandler) set(cfg *collector.Config) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.cfg = cfg
+}
+
+func (h *configHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mtx.RLock()
+	data, err := json.MarshalIndent(h.cfg, "", "  ")
+	h.mtx.RUnlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error encoding config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+// procCollector is implemented by collector.ProcCollector and
+// collector.MultiProcCollector.
+type procCollector interface {
+	prometheus.Collector
+	SetMatchNamer(matchnamer collector.MatchNamer)
+	ForContext(ctx context.Context, group string) prometheus.Collector
+}
+
+// scrapeHandler serves the metrics of c along with those of the default
+// registry. Reading processes stops at the deadline of the request, given by
+// the X-Prometheus-Scrape-Timeout-Seconds header less offset, or when the
+// client goes away. Requests with a group parameter, like
+// /metrics?group=nginx, are served only the series of that group.
+func scrapeHandler(c procCollector, opts handlerOpts, offset time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if timeout := requestTimeout(r, offset); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		group := r.URL.Query().Get("group")
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c.ForContext(ctx, group))
+		var gatherer prometheus.Gatherer = gatherers{prometheus.DefaultGatherer, reg}
+		if group != "" {
+			gatherer = reg
+		}
+		serveMetrics(w, r, gatherer, opts)
+	})
+}
+
+// gatherers is like prometheus.Gatherers, which drops the units of metric
+// families. The metrics of families gathered more than once are merged into
+// the first one, without the consistency checks of prometheus.Gatherers.
+type gatherers []prometheus.Gatherer
+
+func (gs gatherers) Gather() ([]*dto.MetricFamily, error) {
+	var (
+		mfs    []*dto.MetricFamily
+		byName = make(map[string]*dto.MetricFamily)
+		errs   prometheus.MultiError
+	)
+	for _, g := range gs {
+		gathered, err := g.Gather()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, mf := range gathered {
+			if first, ok := byName[mf.GetName()]; ok {
+				first.Metric = append(first.Metric, mf.Metric...)
+				continue
+			}
+			byName[mf.GetName()] = mf
+			mfs = append(mfs, mf)
+		}
+	}
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs, errs.MaybeUnwrap()
+}
+
+// handlerOpts are the options of scrapeHandler.
+type handlerOpts struct {
+	// disableCompression never gzips responses.
+	disableCompression bool
+	// forceCompression gzips responses regardless of Accept-Encoding.
+	forceCompression bool
+	// disableOpenMetrics never serves the OpenMetrics format, even if the
+	// client prefers it.
+	disableOpenMetrics bool
+}
+
+// serveMetrics writes the metrics of g to w with promhttp, which negotiates
+// the format from the Accept header of r, OpenMetrics included unless
+// disabled by opts, and fails with a 500 if gathering fails. Responses are
+// gzipped if the client accepts it, or regardless if forced by opts.
+func serveMetrics(w http.ResponseWriter, r *http.Request, g prometheus.Gatherer, opts handlerOpts) {
+	if opts.forceCompression {
+		r = r.Clone(r.Context())
+		r.Header.Set("Accept-Encoding", "gzip")
+	} else if !opts.disableCompression {
+		// the encoding depends on the request, which caches have to know
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if !opts.disableOpenMetrics && expfmt.NegotiateIncludingOpenMetrics(r.Header).FormatType() == expfmt.TypeOpenMetrics {
+		g = openMetricsGatherer{g}
+	}
+	promhttp.HandlerFor(g, promhttp.HandlerOpts{
+		ErrorLog:            promhttpLogger{},
+		DisableCompression:  opts.disableCompression,
+		OfferedCompressions: []promhttp.Compression{promhttp.Identity, promhttp.Gzip},
+		EnableOpenMetrics:   !opts.disableOpenMetrics,
+	}).ServeHTTP(w, r)
+}
+
+// openMetricsGatherer leaves out the counters of a Gatherer whose name lacks
+// the _total suffix, such as proc_scrape_errors with -compat.scrape-errors.
+// OpenMetrics names counter families without the suffix, so that they would
+// clash with the family of the suffixed counter.
+type openMetricsGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g openMetricsGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	kept := mfs[:0]
+	for _, mf := range mfs {
+		if mf.GetType() == dto.MetricType_COUNTER && !strings.HasSuffix(mf.GetName(), "_total") {
+			continue
+		}
+		kept = append(kept, mf)
+	}
+	return kept, err
+}
+
+// promhttpLogger logs the errors of promhttp handlers.
+type promhttpLogger struct{}
+
+func (promhttpLogger) Println(v ...interface{}) {
+	log.Errorln(v...)
+}
+
+// requestTimeout returns the scrape timeout Prometheus sends in the
+// X-Prometheus-Scrape-Timeout-Seconds header less offset, or 0 if there is
+// none. Timeouts not longer than offset are returned unchanged.
+func requestTimeout(r *http.Request, offset time.Duration) time.Duration {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		log.Debugf("Ignoring invalid scrape timeout header %q", header)
+		return 0
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
+	}
+	return timeout
+}
+
+// limitRequests serves at most n requests at a time with h and rejects the
+// others, like promhttp.HandlerOpts.MaxRequestsInFlight of newer client_golang
+// versions would, were there a single handler. No limit when n is 0.
+func limitRequests(n int, h http.Handler) http.Handler {
+	if n <= 0 {
+		return h
+	}
+	inFlight := make(chan struct{}, n)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+		default:
+			http.Error(w, fmt.Sprintf("Limit of concurrent requests reached (%d), try again later.", n), http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// instrumentMetricHandler counts the requests served by h by status code,
+// including those rejected by limitRequests, and tracks those in flight. The
+// metrics are named like those of promhttp.InstrumentMetricHandler, so that
+// existing dashboards keep working.
+func instrumentMetricHandler(reg prometheus.Registerer, h http.Handler) http.Handler {
+	requests := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promhttp_metric_handler_requests_total",
+			Help: "Total number of scrapes by HTTP status code.",
+		},
+		[]string{"code"},
+	)
+	// initialized so that the series exist before the first error
+	requests.WithLabelValues("200")
+	requests.WithLabelValues("500")
+	requests.WithLabelValues("503")
+	inFlight := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promhttp_metric_handler_requests_in_flight",
+		Help: "Current number of scrapes being served.",
+	})
+	reg.MustRegister(requests, inFlight)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Inc()
+		defer inFlight.Dec()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		requests.WithLabelValues(strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// statusRecorder remembers the status code written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests wraps h to log every request it serves. X-Forwarded-For is
+// logged along with the remote address when present, to see past load
+// balancers; clients can set it to anything, so it doesn't replace it.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		l := log.With("method", r.Method).
+			With("path", r.URL.Path).
+			With("remote", r.RemoteAddr)
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			l = l.With("forwarded_for", fwd)
+		}
+		l.With("status", rec.status).
+			With("duration", time.Since(start).Seconds()).
+			Infoln("Served request")
+	})
+}
+
+// printMatches writes the group assigned to each process to w, sorted by
+// group name with unmatched processes last.
+func printMatches(w io.Writer, procfsPath string, matchnamer collector.MatchNamer) error {
+	matches, err := collector.MatchProcs(procfsPath, matchnamer)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.Matched != b.Matched {
+			return a.Matched
+		}
+		if a.GroupName != b.GroupName {
+			return a.GroupName < b.GroupName
+		}
+		return a.PID < b.PID
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tPID\tCOMM\tCMDLINE")
+	for _, m := range matches {
+		group := m.GroupName
+		if !m.Matched {
+			group = "unmatched"
+		}
+		// truncated by runes, not to cut a character in half
+		cmdline := []rune(strings.Join(m.Cmdline, " "))
+		if len(cmdline) > 60 {
+			cmdline = append(cmdline[:57], []rune("...")...)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", group, m.PID, m.Name, string(cmdline))
+	}
+	return tw.Flush()
+}
+
+// printMetrics writes the metrics of g to w in the text format. It fails if
+// reading processes failed outright, i.e. scrape errors were counted but no
+// group was collected.
+func printMetrics(w io.Writer, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	var groups int
+	var scrapeErrors float64
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "proc_num_procs":
+			groups += len(mf.Metric)
+		case "proc_scrape_errors_total":
+			for _, m := range mf.Metric {
+				scrapeErrors += m.GetCounter().GetValue()
+			}
+		}
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	if groups == 0 && scrapeErrors > 0 {
+		return fmt.Errorf("no process could be read")
+	}
+	return nil
+}
+
+// parseProcfsPaths parses a comma-separated list of procfs paths and globs.
+func parseProcfsPaths(s string) ([]string, error) {
+	var paths []string
+	for _, path := range strings.Split(s, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if _, err := filepath.Match(path, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", path, err)
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no path given")
+	}
+	return paths, nil
+}
+
+// parseAggregations parses a comma-separated list of family=aggregation
+// pairs.
+func parseAggregations(s string) (map[string]collector.Aggregation, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	aggregations := make(map[string]collector.Aggregation)
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected family=aggregation, got %q", kv)
+		}
+		if _, ok := collector.DefaultAggregations[parts[0]]; !ok {
+			return nil, fmt.Errorf("unknown metric family %q", parts[0])
+		}
+		switch a := collector.Aggregation(parts[1]); a {
+		case collector.AggregateSum, collector.AggregateMax, collector.AggregateMin, collector.AggregateAvg:
+			aggregations[parts[0]] = a
+		default:
+			return nil, fmt.Errorf("unknown aggregation %q", parts[1])
+		}
+	}
+	return aggregations, nil
+}
+
+// stringList is a flag.Value collecting the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseFloats parses a comma-separated list of numbers, such as histogram
+// bucket bounds or quantiles.
+func parseFloats(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var floats []float64
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, err
+		}
+		floats = append(floats, v)
+	}
+	return floats, nil
 }
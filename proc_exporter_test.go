@@ -0,0 +1,210 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/catawiki/proc_exporter/collector"
+)
+
+func TestPusher(t *testing.T) {
+	var (
+		method, path, contentType string
+		mfs                       []*dto.MetricFamily
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, contentType = r.Method, r.URL.EscapedPath(), r.Header.Get("Content-Type")
+		dec := expfmt.NewDecoder(r.Body, expfmt.Format(contentType))
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err != nil {
+				break
+			}
+			mfs = append(mfs, &mf)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gateway.Close()
+
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "Test."})
+	g.Set(42)
+	reg.MustRegister(g)
+
+	p, err := newPusher(gateway.URL+"/", "proc exporter", []string{"instance=host:9256", "dc=ams"}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.push(); err != nil {
+		t.Fatal(err)
+	}
+
+	if method != http.MethodPut {
+		t.Errorf("method = %s, want PUT", method)
+	}
+	if want := "/metrics/job/proc+exporter/instance/host%3A9256/dc/ams"; path != want {
+		t.Errorf("path = %s, want %s", path, want)
+	}
+	if contentType != string(expfmt.FmtProtoDelim) {
+		t.Errorf("content type = %q, want %q", contentType, expfmt.FmtProtoDelim)
+	}
+	if len(mfs) != 1 || mfs[0].GetName() != "test_gauge" || mfs[0].Metric[0].GetGauge().GetValue() != 42 {
+		t.Errorf("pushed %v, want test_gauge 42", mfs)
+	}
+}
+
+func TestPusherErrors(t *testing.T) {
+	for _, tc := range []struct {
+		job      string
+		grouping []string
+		err      string
+	}{
+		{"", nil, "invalid job name"},
+		{"a/b", nil, "invalid job name"},
+		{"job", []string{"instance"}, "expected name=value"},
+		{"job", []string{"0instance=a"}, "invalid grouping label name"},
+		{"job", []string{"job=a"}, "invalid grouping label name"},
+		{"job", []string{"path=/a"}, "contains '/'"},
+	} {
+		_, err := newPusher("localhost:9091", tc.job, tc.grouping, prometheus.NewRegistry())
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("newPusher(%q, %q) = %v, want error containing %q", tc.job, tc.grouping, err, tc.err)
+		}
+	}
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		http.Error(w, "bad metrics", http.StatusBadRequest)
+	}))
+	defer gateway.Close()
+	p, err := newPusher(gateway.URL, "job", nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.push(); err == nil || !strings.Contains(err.Error(), "bad metrics") {
+		t.Errorf("push() = %v, want error with the response body", err)
+	}
+}
+
+func TestServeMetricsCompression(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "Test."})
+	reg.MustRegister(g)
+
+	for _, tc := range []struct {
+		opts           handlerOpts
+		acceptEncoding string
+		gzipped        bool
+		vary           bool
+	}{
+		{handlerOpts{}, "", false, true},
+		{handlerOpts{}, "gzip", true, true},
+		{handlerOpts{}, "deflate, gzip;q=1.0", true, true},
+		{handlerOpts{disableCompression: true}, "gzip", false, false},
+		{handlerOpts{forceCompression: true}, "", true, false},
+		{handlerOpts{forceCompression: true}, "gzip", true, false},
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if tc.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		serveMetrics(w, r, reg, tc.opts)
+
+		if vary := w.Header().Get("Vary") == "Accept-Encoding"; vary != tc.vary {
+			t.Errorf("%+v with Accept-Encoding %q: Vary = %q, want Accept-Encoding: %v", tc.opts, tc.acceptEncoding, w.Header().Get("Vary"), tc.vary)
+		}
+		body := io.Reader(w.Body)
+		if gzipped := w.Header().Get("Content-Encoding") == "gzip"; gzipped != tc.gzipped {
+			t.Errorf("%+v with Accept-Encoding %q: gzipped = %v, want %v", tc.opts, tc.acceptEncoding, gzipped, tc.gzipped)
+			continue
+		} else if gzipped {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gz
+		}
+		text, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(text), "test_gauge 0") {
+			t.Errorf("%+v with Accept-Encoding %q: body %q lacks test_gauge", tc.opts, tc.acceptEncoding, text)
+		}
+	}
+}
+
+func TestServeMetricsSelfMonitoring(t *testing.T) {
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	serveMetrics(w, r, prometheus.DefaultGatherer, handlerOpts{})
+
+	// the default registry comes with the process and Go collectors
+	want := []string{"go_goroutines ", "go_memstats_alloc_bytes "}
+	if runtime.GOOS == "linux" {
+		want = append(want, "process_cpu_seconds_total ", "process_open_fds ", "process_start_time_seconds ")
+	}
+	body := w.Body.String()
+	for _, name := range want {
+		if !strings.Contains(body, "\n"+name) {
+			t.Errorf("body lacks %s", name)
+		}
+	}
+}
+
+func TestServeMetricsOpenMetrics(t *testing.T) {
+	cfg, err := collector.GetConfig(`
+process_names:
+  - comm: [no-such-process]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector.NewProcCollector("/proc", cfg.MatchNamers, collector.Options{NoFds: true, LegacyScrapeErrors: true}))
+
+	for _, tc := range []struct {
+		opts        handlerOpts
+		contentType expfmt.FormatType
+		want        []string
+	}{
+		// the unsuffixed counter would clash with the family of
+		// proc_scrape_errors_total
+		{handlerOpts{}, expfmt.TypeOpenMetrics, []string{
+			"# TYPE proc_scrape_errors counter\n",
+			"\nproc_scrape_errors_total 0.0\n",
+			"# UNIT proc_scrape_stage_duration_seconds seconds\n",
+			"\n# EOF\n",
+		}},
+		{handlerOpts{disableOpenMetrics: true}, expfmt.TypeTextPlain, []string{"\nproc_scrape_errors_total 0\n", "\nproc_scrape_errors 0\n"}},
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+		w := httptest.NewRecorder()
+		serveMetrics(w, r, gatherers{prometheus.DefaultGatherer, reg}, tc.opts)
+
+		if got := expfmt.Format(w.Header().Get("Content-Type")).FormatType(); got != tc.contentType {
+			t.Errorf("%+v: content type = %q, want %v", tc.opts, w.Header().Get("Content-Type"), tc.contentType)
+		}
+		body := w.Body.String()
+		for _, s := range tc.want {
+			if strings.Count(body, s) != 1 {
+				t.Errorf("%+v: body lacks %q once:\n%s", tc.opts, s, body)
+			}
+		}
+		if n := strings.Count(body, "# TYPE proc_scrape_errors "); n != 1 {
+			t.Errorf("%+v: %d proc_scrape_errors families, want 1", tc.opts, n)
+		}
+	}
+}